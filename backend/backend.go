@@ -5,18 +5,25 @@
 // of it to the Run function. Optional messages in the protocol may be supported by having the type
 // additionally implement the "Has*" interfaces.
 //
+// Behavior such as caching can be layered onto an implementation by wrapping it in another
+// BackendV1 that implements Unwrapper.
+//
 // See https://git-annex.branchable.com/design/external_backend_protocol/ for further information
 // regarding the underlying protocol and the semantics of its operations.
 package backend
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/dzhu/go-git-annex-external/internal"
+	"github.com/dzhu/go-git-annex-external/key"
 )
 
 const (
@@ -37,6 +44,38 @@ type BackendV1 interface {
 	GenKey(a Annex, file string) (string, bool, error)
 }
 
+// KeyFields selects the optional fields of a key generated with HasGenKeyV2.
+type KeyFields struct {
+	// Size includes the size of the file, as the "-s" field.
+	Size bool
+	// Mtime includes the modification time of the file, in seconds since the Unix epoch, as the "-m"
+	// field, as git-annex's WORM and URL backends do. Since it does not depend on the content of the
+	// file, it is normally only used by backends that are not stable.
+	Mtime bool
+}
+
+// HasGenKeyV2 is like BackendV1.GenKey, but allows a backend implementation to choose more of the
+// fields of its keys. A backend implementing it is used through it rather than through GenKey.
+//
+// Unlike the other optional interfaces, it is not looked for in the backends wrapped by a backend
+// (see Unwrapper), since that would bypass the GenKey of the wrapper; a wrapper that changes GenKey
+// should implement it as well.
+type HasGenKeyV2 interface {
+	// GenKeyV2 returns the key name for the content of the given file and which of the optional
+	// fields to include in the full key.
+	GenKeyV2(a Annex, file string) (string, KeyFields, error)
+}
+
+// GenKeyFields generates a key name for the file with b, using GenKeyV2 if b implements
+// HasGenKeyV2 and GenKey otherwise.
+func GenKeyFields(a Annex, b BackendV1, file string) (string, KeyFields, error) {
+	if h, ok := b.(HasGenKeyV2); ok {
+		return h.GenKeyV2(a, file)
+	}
+	name, useSize, err := b.GenKey(a, file)
+	return name, KeyFields{Size: useSize}, err
+}
+
 // HasVerifyKeyContent is the interface that a backend implementation must implement to indicate
 // that it supports verifying keys against files.
 type HasVerifyKeyContent interface {
@@ -47,6 +86,33 @@ type HasVerifyKeyContent interface {
 	IsCryptographicallySecure(a Annex) bool
 }
 
+// HasVerifyKeyContentV2 is like HasVerifyKeyContent, but allows a backend implementation to report
+// why content could not be checked. A backend implementing both interfaces is used through this
+// one.
+type HasVerifyKeyContentV2 interface {
+	// VerifyKeyContentV2 checks whether the given key is valid for the content of the given file.
+	// It returns an error, which is reported to git-annex as a debug message, if the content could
+	// not be checked, such as when the file cannot be read.
+	VerifyKeyContentV2(a Annex, key, file string) (bool, error)
+	// IsCryptographicallySecure indicates whether the verification done by this backend is
+	// cryptographically secure.
+	IsCryptographicallySecure(a Annex) bool
+}
+
+// HasExtensionKeys is the interface that a backend implementation may implement to have the
+// extension of each file appended to the names of its keys, like git-annex's "E" backends such as
+// SHA256E. The extension follows git-annex's rules: it consists of at most the last two extensions
+// of the file, each of at most four characters, and only extensions made of letters and digits
+// are kept. The extension is removed from the key name again before it is passed to
+// VerifyKeyContent.
+//
+// Names generated by such a backend must not contain a dot, and by convention the backend's name
+// should end in "E".
+type HasExtensionKeys interface {
+	// ExtensionKeys indicates whether to include the extensions of files in keys.
+	ExtensionKeys(a Annex) bool
+}
+
 // Annex allows external backend implementations to send requests to git-annex.
 type Annex interface {
 	Progress(bytes int)
@@ -86,8 +152,30 @@ func (a *annexIO) sendFailure(cmd string, args ...interface{}) {
 	a.send(cmd+"-FAILURE", args...)
 }
 
+// verifierV1 adapts a HasVerifyKeyContent to HasVerifyKeyContentV2.
+type verifierV1 struct {
+	HasVerifyKeyContent
+}
+
+func (v verifierV1) VerifyKeyContentV2(a Annex, key, file string) (bool, error) {
+	return v.VerifyKeyContent(a, key, file), nil
+}
+
+// verifier returns the implementation's support for verifying content, or nil if it has none.
+func verifier(b BackendV1) HasVerifyKeyContentV2 {
+	var h2 HasVerifyKeyContentV2
+	if As(b, &h2) {
+		return h2
+	}
+	var h1 HasVerifyKeyContent
+	if As(b, &h1) {
+		return verifierV1{h1}
+	}
+	return nil
+}
+
 func (a *annexIO) canVerify() {
-	if _, ok := a.impl.(HasVerifyKeyContent); !ok {
+	if verifier(a.impl) == nil {
 		a.sendNo(cmdCanVerify)
 		return
 	}
@@ -103,8 +191,8 @@ func (a *annexIO) isStable() {
 }
 
 func (a *annexIO) isCryptographicallySecure() {
-	h, ok := a.impl.(HasVerifyKeyContent)
-	if !ok || !h.IsCryptographicallySecure(a) {
+	h := verifier(a.impl)
+	if h == nil || !h.IsCryptographicallySecure(a) {
 		a.sendNo(cmdIsCryptographicallySecure)
 		return
 	}
@@ -112,38 +200,96 @@ func (a *annexIO) isCryptographicallySecure() {
 }
 
 func (a *annexIO) genKey(file string) {
-	name, useSize, err := a.impl.GenKey(a, file)
+	k, err := makeKey(a, a.impl, "X"+a.name, file)
 	if err != nil {
 		a.sendFailure(cmdGenKey, err)
 		return
 	}
+	a.sendSuccess(cmdGenKey, k)
+}
+
+// makeKey generates the full key for the file with b, using the given backend name in the key.
+func makeKey(a Annex, b BackendV1, backendName, file string) (string, error) {
+	name, fields, err := GenKeyFields(a, b, file)
+	if err != nil {
+		return "", err
+	}
 
-	var key string
+	k := key.Key{Backend: backendName, Name: name}
 
-	if useSize {
+	if extensionKeys(a, b) {
+		if strings.Contains(name, ".") {
+			return "", fmt.Errorf("generated name %q contains a dot", name)
+		}
+		k.Name += keyExtension(file)
+	}
+
+	if fields.Size || fields.Mtime {
 		stat, err := os.Stat(file)
 		if err != nil {
-			a.sendFailure(cmdGenKey, err)
-			return
+			return "", err
+		}
+		if fields.Size {
+			k.Size, k.HasSize = stat.Size(), true
+		}
+		if fields.Mtime {
+			k.Mtime, k.HasMtime = stat.ModTime().Unix(), true
 		}
-		key = fmt.Sprintf("X%s-s%d--%s", a.name, stat.Size(), name)
-	} else {
-		key = fmt.Sprintf("X%s--%s", a.name, name)
 	}
 
-	a.sendSuccess(cmdGenKey, key)
+	if err := k.Validate(); err != nil {
+		return "", err
+	}
+	return k.String(), nil
 }
 
-func (a *annexIO) verifyKeyContent(key, file string) {
-	name := strings.SplitAfterN(key, "--", 2)[1]
-	h, _ := a.impl.(HasVerifyKeyContent)
-	if !h.VerifyKeyContent(a, name, file) {
+func (a *annexIO) verifyKeyContent(keyStr, file string) {
+	ok, err := checkKey(a, a.impl, keyStr, file)
+	if err != nil {
+		a.Debugf("%v", err)
+	}
+	if err != nil || !ok {
 		a.sendFailure(cmdVerifyKeyContent)
 		return
 	}
 	a.sendSuccess(cmdVerifyKeyContent)
 }
 
+// checkKey checks whether the full key is valid for the content of the file according to b. It
+// returns an error if b cannot verify content or the content could not be checked.
+func checkKey(a Annex, b BackendV1, keyStr, file string) (bool, error) {
+	h := verifier(b)
+	if h == nil {
+		return false, errors.New("backend cannot verify content")
+	}
+	k, err := key.Parse(keyStr)
+	if err != nil {
+		return false, err
+	}
+	// Check the size first, since it is much cheaper than checking the content.
+	if k.HasSize {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		if stat.Size() != k.Size {
+			a.Debugf("size of %s is %d, but key %s has size %d", file, stat.Size(), keyStr, k.Size)
+			return false, nil
+		}
+	}
+	name := k.Name + k.Extension
+	if extensionKeys(a, b) {
+		if i := strings.IndexByte(name, '.'); i >= 0 {
+			name = name[:i]
+		}
+	}
+	ok, err := h.VerifyKeyContentV2(a, name, file)
+	if err != nil {
+		return false, fmt.Errorf("verifying %s: %w", keyStr, err)
+	}
+	return ok, nil
+}
+
 func (a *annexIO) Progress(bytes int) {
 	a.send("PROGRESS", strconv.Itoa(bytes))
 }
@@ -164,21 +310,98 @@ func (a *annexIO) Errorf(format string, args ...interface{}) {
 	a.Error(fmt.Sprintf(format, args...))
 }
 
-func getBackendName() string {
+// Options holds settings for RunWithOptions.
+type Options struct {
+	// Name is the name of the backend, without the "X" prefix that git-annex gives the names of
+	// external backends; keys generated by the backend begin with "X" followed by the name. Names
+	// may contain only ASCII letters, digits, and underscores. If Name is empty, it is taken from
+	// the name of the program, which git-annex runs as "git-annex-backend-X" followed by the name.
+	Name string
+	// In and Out are the streams over which the backend communicates with git-annex. If they are
+	// nil, standard input and standard output are used.
+	In  io.Reader
+	Out io.Writer
+}
+
+// ValidateName checks that name can be used as the name of a backend (see Options.Name).
+func ValidateName(name string) error {
+	if name == "" {
+		return errors.New("empty backend name")
+	}
+	for _, c := range name {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_') {
+			return fmt.Errorf("invalid backend name %q: only ASCII letters, digits, and underscores are allowed", name)
+		}
+	}
+	return nil
+}
+
+// programBackendName returns the backend name given by the name under which the program was run.
+func programBackendName() (string, error) {
 	const prefix = "git-annex-backend-X"
-	prog := filepath.Base(os.Args[0])
+	prog := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
 	rest := strings.TrimPrefix(prog, prefix)
-	if rest == prog {
-		return ""
+	if rest == prog || rest == "" {
+		return "", fmt.Errorf("cannot determine the backend name from the program name %q, which should be %s<name>", prog, prefix)
 	}
-	return rest
+	return rest, nil
 }
 
 // Run executes an external backend as git-annex expects, reading from stdin and writing to stdout.
+// The name of the backend is taken from the name of the program.
 func Run(b BackendV1) {
-	name := getBackendName()
-	internal.Run(func(lines internal.LineIO) map[string]internal.CommandSpec {
+	RunWithOptions(b, Options{})
+}
+
+// RunWithOptions is like Run, but with the given options.
+func RunWithOptions(b BackendV1, opts Options) {
+	name, err := opts.Name, error(nil)
+	if name == "" {
+		name, err = programBackendName()
+	}
+	if err == nil {
+		err = ValidateName(name)
+	}
+	run(b, name, err, opts)
+}
+
+// RunMultiple executes whichever of the given backends, keyed by name, is named by the name of
+// the program, so that a single program can serve several backends through symlinks named
+// "git-annex-backend-X" followed by each name.
+func RunMultiple(backends map[string]BackendV1) {
+	name, err := programBackendName()
+	b := backends[name]
+	if err == nil && b == nil {
+		names := make([]string, 0, len(backends))
+		for n := range backends {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		err = fmt.Errorf("no backend named %q in this program (available: %s)", name, strings.Join(names, ", "))
+	}
+	if err == nil {
+		err = ValidateName(name)
+	}
+	run(b, name, err, Options{})
+}
+
+// run executes the backend with the given name, or, if err is not nil, reports it to git-annex
+// instead. Only the streams are used from opts.
+func run(b BackendV1, name string, err error, opts Options) {
+	in, out := opts.In, opts.Out
+	if in == nil {
+		in = os.Stdin
+	}
+	if out == nil {
+		out = os.Stdout
+	}
+	internal.RunWithStreams(in, out, func(lines internal.LineIO) map[string]internal.CommandSpec {
 		a := &annexIO{io: lines, impl: b, name: name}
+		if err != nil {
+			return map[string]internal.CommandSpec{
+				internal.StartupCmd: internal.Response0(func() { a.Error(err.Error()) }),
+			}
+		}
 		return map[string]internal.CommandSpec{
 			cmdGetVersion:                internal.Response0(a.getVersion),
 			cmdCanVerify:                 internal.Response0(a.canVerify),
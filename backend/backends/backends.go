@@ -0,0 +1,122 @@
+// Package backends provides ready-made external backends built on the backend package. Each
+// function returns a backend that can be passed to backend.Run; the cmd directory of this module
+// contains a program for each one.
+//
+// All of these backends are stable, can verify content, and include the size of files in their
+// keys. Their names are chosen not to clash with git-annex's own backends, since git-annex prefixes
+// the names of external backends with "X": the BLAKE2B256 backend here generates keys like
+// "XBLAKE2B256-s1024--<hash>", distinct from the native backend's "BLAKE2B256-s1024--<hash>", even
+// though the hashes are the same.
+package backends
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"hash/crc64"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/dzhu/go-git-annex-external/backend"
+)
+
+// ShortHash returns a backend whose keys are named by the hex-encoded first four bytes of the
+// SHA-512 hash of the content of files. It is meant as a demonstration; such short hashes are
+// likely to collide in large repositories.
+func ShortHash() *backend.HashBackend {
+	return &backend.HashBackend{
+		New: sha512.New,
+		Encode: func(sum []byte) string {
+			return hex.EncodeToString(sum[:4])
+		},
+	}
+}
+
+// BLAKE2B256 returns a backend whose keys are named by the hex-encoded BLAKE2b-256 hash of the
+// content of files.
+func BLAKE2B256() *backend.HashBackend {
+	return &backend.HashBackend{
+		New: func() hash.Hash {
+			// New256 fails only for keys that are too long.
+			h, _ := blake2b.New256(nil)
+			return h
+		},
+		Secure: true,
+	}
+}
+
+// SHA3_256 returns a backend whose keys are named by the hex-encoded SHA3-256 hash of the content
+// of files.
+func SHA3_256() *backend.HashBackend {
+	return &backend.HashBackend{New: sha3.New256, Secure: true}
+}
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// CRC64 returns a backend whose keys are named by the hex-encoded CRC-64 (ECMA) checksum of the
+// content of files. It is much faster than the other backends, but since the checksum is not a
+// cryptographic hash, anyone able to modify content can easily make it match an existing key, so
+// git-annex is told that the backend is not cryptographically secure.
+func CRC64() *backend.HashBackend {
+	return &backend.HashBackend{
+		New: func() hash.Hash {
+			return crc64.New(crc64Table)
+		},
+	}
+}
+
+// Multihash and multibase codes used by the Multihash backend.
+const (
+	multihashSHA256 = 0x12
+	multibaseBase16 = "f"
+)
+
+// Multihash returns a backend whose keys are named by the SHA-256 hash of the content of files in
+// the self-describing multihash format (https://multiformats.io/multihash/), encoded as lowercase
+// hexadecimal with the multibase prefix "f", for example "f1220" followed by the hex-encoded hash.
+func Multihash() *backend.HashBackend {
+	return &backend.HashBackend{
+		New: sha256.New,
+		Encode: func(sum []byte) string {
+			mh := append([]byte{multihashSHA256, byte(len(sum))}, sum...)
+			return multibaseBase16 + hex.EncodeToString(mh)
+		},
+		Secure: true,
+	}
+}
+
+// CDC returns a backend whose keys are named by the hex-encoded SHA-256 hash of the list of the
+// SHA-256 hashes of the content-defined chunks of files, split with cdc.DefaultParams. Its chunks
+// are the same as those stored by the remote/dedup wrapper with its default settings. It does not
+// write manifests; to have the manifest of each file written in a file named by the name of the key,
+// set the ManifestDir field of the result, for example to the directory returned by ManifestDir.
+func CDC() *backend.CDCBackend {
+	return &backend.CDCBackend{New: sha256.New, Secure: true}
+}
+
+// ManifestDir returns a directory inside the user's cache directory to which the CDC backend may
+// write manifests.
+func ManifestDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "go-git-annex-external", "manifests"), nil
+}
+
+// All returns all of the backends in this package, keyed by the names under which the programs in
+// the cmd directory of this module run them, for use with backend.RunMultiple.
+func All() map[string]backend.BackendV1 {
+	return map[string]backend.BackendV1{
+		"SHORTHASH":  ShortHash(),
+		"BLAKE2B256": BLAKE2B256(),
+		"SHA3_256":   SHA3_256(),
+		"CRC64":      CRC64(),
+		"MULTIHASH":  Multihash(),
+		"CDC":        CDC(),
+	}
+}
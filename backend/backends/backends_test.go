@@ -0,0 +1,30 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/dzhu/go-git-annex-external/backend"
+	"github.com/dzhu/go-git-annex-external/backend/backendtest"
+)
+
+func TestAll(t *testing.T) {
+	all := All()
+	for _, name := range []string{"BLAKE2B256", "SHA3_256", "CRC64", "MULTIHASH", "CDC", "SHORTHASH"} {
+		if _, ok := all[name]; !ok {
+			t.Errorf("All() lacks %s", name)
+		}
+	}
+	for name, b := range all {
+		name, b := name, b
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			// Exercise writing manifests, but not into the user's cache directory.
+			if c, ok := b.(*backend.CDCBackend); ok {
+				c.ManifestDir = t.TempDir()
+			}
+			if err := backendtest.Check(b, name); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+// Package backendtest runs external backends in-process through the git-annex external backend
+// protocol, so that they can be tested without git-annex.
+//
+// A Harness plays the part of git-annex: it sends requests to the backend and parses its replies.
+// Check uses a harness to run a standard set of checks that any backend should pass.
+package backendtest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dzhu/go-git-annex-external/backend"
+	"github.com/dzhu/go-git-annex-external/key"
+)
+
+// DefaultTimeout is how long a Harness waits for each reply if its Timeout is zero.
+const DefaultTimeout = time.Minute
+
+// Harness runs a backend and communicates with it as git-annex would.
+type Harness struct {
+	// Timeout is how long to wait for each reply.
+	Timeout time.Duration
+	// Messages collects the PROGRESS and DEBUG messages sent by the backend.
+	Messages []string
+
+	in    *io.PipeWriter
+	lines chan string
+}
+
+// Start starts running the backend under the given name.
+func Start(b backend.BackendV1, name string) *Harness {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	h := &Harness{in: inW, lines: make(chan string)}
+	go func() {
+		backend.RunWithOptions(b, backend.Options{Name: name, In: inR, Out: outW})
+		outW.Close()
+	}()
+	go func() {
+		s := bufio.NewScanner(outR)
+		for s.Scan() {
+			h.lines <- s.Text()
+		}
+		close(h.lines)
+	}()
+	return h
+}
+
+// Close stops the backend.
+func (h *Harness) Close() error {
+	h.in.Close()
+	// Discard any remaining output until the backend exits.
+	timeout := time.After(h.timeout())
+	for {
+		select {
+		case _, ok := <-h.lines:
+			if !ok {
+				return nil
+			}
+		case <-timeout:
+			return errors.New("backend did not exit")
+		}
+	}
+}
+
+func (h *Harness) timeout() time.Duration {
+	if h.Timeout > 0 {
+		return h.Timeout
+	}
+	return DefaultTimeout
+}
+
+// Request sends a request to the backend and returns its reply, collecting any PROGRESS and DEBUG
+// messages sent before it in Messages. It returns an error if the backend sends ERROR.
+func (h *Harness) Request(request string) (string, error) {
+	if _, err := fmt.Fprintln(h.in, request); err != nil {
+		return "", err
+	}
+	timeout := time.After(h.timeout())
+	for {
+		select {
+		case line, ok := <-h.lines:
+			if !ok {
+				return "", fmt.Errorf("%s: backend exited without replying", request)
+			}
+			switch {
+			case strings.HasPrefix(line, "PROGRESS "), strings.HasPrefix(line, "DEBUG "):
+				h.Messages = append(h.Messages, line)
+			case strings.HasPrefix(line, "ERROR "):
+				return "", fmt.Errorf("%s: backend sent %s", request, line)
+			default:
+				return line, nil
+			}
+		case <-timeout:
+			return "", fmt.Errorf("%s: timed out waiting for a reply", request)
+		}
+	}
+}
+
+// yesNo sends a request whose reply is "<request>-YES" or "<request>-NO".
+func (h *Harness) yesNo(request string) (bool, error) {
+	reply, err := h.Request(request)
+	switch {
+	case err != nil:
+		return false, err
+	case reply == request+"-YES":
+		return true, nil
+	case reply == request+"-NO":
+		return false, nil
+	}
+	return false, fmt.Errorf("%s: unexpected reply %q", request, reply)
+}
+
+// CanVerify asks whether the backend can verify content.
+func (h *Harness) CanVerify() (bool, error) {
+	return h.yesNo("CANVERIFY")
+}
+
+// IsStable asks whether the backend is stable.
+func (h *Harness) IsStable() (bool, error) {
+	return h.yesNo("ISSTABLE")
+}
+
+// IsCryptographicallySecure asks whether the backend is cryptographically secure.
+func (h *Harness) IsCryptographicallySecure() (bool, error) {
+	return h.yesNo("ISCRYPTOGRAPHICALLYSECURE")
+}
+
+// GenKey asks the backend to generate a key for the file.
+func (h *Harness) GenKey(file string) (string, error) {
+	reply, err := h.Request("GENKEY " + file)
+	switch {
+	case err != nil:
+		return "", err
+	case strings.HasPrefix(reply, "GENKEY-SUCCESS "):
+		return strings.TrimPrefix(reply, "GENKEY-SUCCESS "), nil
+	case strings.HasPrefix(reply, "GENKEY-FAILURE "):
+		return "", fmt.Errorf("GENKEY %s: %s", file, strings.TrimPrefix(reply, "GENKEY-FAILURE "))
+	}
+	return "", fmt.Errorf("GENKEY %s: unexpected reply %q", file, reply)
+}
+
+// VerifyKeyContent asks the backend whether the key matches the content of the file.
+func (h *Harness) VerifyKeyContent(k, file string) (bool, error) {
+	reply, err := h.Request("VERIFYKEYCONTENT " + k + " " + file)
+	switch {
+	case err != nil:
+		return false, err
+	case reply == "VERIFYKEYCONTENT-SUCCESS":
+		return true, nil
+	case reply == "VERIFYKEYCONTENT-FAILURE":
+		return false, nil
+	}
+	return false, fmt.Errorf("VERIFYKEYCONTENT %s %s: unexpected reply %q", k, file, reply)
+}
+
+// Check runs the backend under the given name and checks that it follows the protocol: that it
+// generates keys with the right backend name, size, and modification time, that a stable backend
+// generates the same key for the same content, and that a backend that can verify content accepts
+// the keys it generates and rejects them for modified content. It returns the first problem found.
+func Check(b backend.BackendV1, name string) (err error) {
+	dir, err := ioutil.TempDir("", "backendtest-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file.txt")
+	content := []byte("The quick brown fox jumps over the lazy dog.\n")
+	if err := ioutil.WriteFile(file, content, 0o600); err != nil {
+		return err
+	}
+
+	h := Start(b, name)
+	defer func() {
+		if cerr := h.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	if reply, err := h.Request("GETVERSION"); err != nil {
+		return err
+	} else if reply != "VERSION 1" {
+		return fmt.Errorf("GETVERSION: unexpected reply %q", reply)
+	}
+	canVerify, err := h.CanVerify()
+	if err != nil {
+		return err
+	}
+	stable, err := h.IsStable()
+	if err != nil {
+		return err
+	}
+	secure, err := h.IsCryptographicallySecure()
+	if err != nil {
+		return err
+	}
+	if secure && !canVerify {
+		return errors.New("backend claims to be cryptographically secure but cannot verify content")
+	}
+
+	k, err := h.GenKey(file)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	parsed, err := key.Parse(k)
+	switch {
+	case err != nil:
+		return err
+	case parsed.Backend != "X"+name:
+		return fmt.Errorf("key %q does not have the backend name X%s", k, name)
+	case parsed.HasSize && parsed.Size != int64(len(content)):
+		return fmt.Errorf("key %q does not have the size %d", k, len(content))
+	case parsed.HasMtime && parsed.Mtime != stat.ModTime().Unix():
+		return fmt.Errorf("key %q does not have the modification time %d", k, stat.ModTime().Unix())
+	}
+	if stable {
+		k2, err := h.GenKey(file)
+		if err != nil {
+			return err
+		}
+		if k2 != k {
+			return fmt.Errorf("stable backend generated different keys %q and %q for the same content", k, k2)
+		}
+	}
+
+	if !canVerify {
+		return nil
+	}
+	if ok, err := h.VerifyKeyContent(k, file); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("key %q was not verified against the content it was generated for", k)
+	}
+	content[0] ^= 1
+	if err := ioutil.WriteFile(file, content, 0o600); err != nil {
+		return err
+	}
+	if ok, err := h.VerifyKeyContent(k, file); err != nil {
+		return err
+	} else if ok {
+		return fmt.Errorf("key %q was verified against modified content", k)
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+// Package cache provides a wrapper for external backends that remembers the keys generated for
+// files, so that generating keys again for unchanged files, as `git annex add` and similar
+// commands do when run repeatedly over large trees, does not require hashing them again.
+//
+// Each cached key is recorded against the device, inode, size, and modification time of the file
+// it was generated for and the name of the backend, in an append-only log in the user's cache
+// directory. A file whose recorded attributes all still match is assumed to be unchanged. Only
+// GenKey uses the cache; verification always reads the content of the file. Keys are cached only
+// for stable backends (see backend.BackendV1.IsStable), and only on systems that report inode
+// numbers.
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dzhu/go-git-annex-external/backend"
+)
+
+// DefaultMaxEntries is the number of keys kept for each backend if Options.MaxEntries is zero.
+const DefaultMaxEntries = 100000
+
+// Options controls where the cache is kept and how large it may grow.
+type Options struct {
+	// Name distinguishes the entries of the backend from those of other backends using the same
+	// directory. If it is empty, the name of the program is used.
+	Name string
+	// Dir is the directory in which the cache is kept. If it is empty, DefaultDir is used.
+	Dir string
+	// MaxEntries is the number of keys kept; the least recently generated keys beyond this number
+	// are discarded when the cache is next loaded. If it is zero, DefaultMaxEntries is used.
+	MaxEntries int
+}
+
+func (o Options) name() string {
+	if o.Name != "" {
+		return o.Name
+	}
+	return strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+}
+
+func (o Options) dir() (string, error) {
+	if o.Dir != "" {
+		return o.Dir, nil
+	}
+	return DefaultDir()
+}
+
+func (o Options) path() (string, error) {
+	dir, err := o.dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, o.name()+".log"), nil
+}
+
+// DefaultDir returns the directory in which caches are kept by default, inside the user's cache
+// directory.
+func DefaultDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "go-git-annex-external", "keys"), nil
+}
+
+// Clear deletes the cache described by the options.
+func Clear(opts Options) error {
+	path, err := opts.path()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// fileID identifies a version of a file.
+type fileID struct {
+	dev, ino    uint64
+	size, mtime int64
+}
+
+type entry struct {
+	name   string
+	fields backend.KeyFields
+	// seq orders the entries by when they were generated.
+	seq int
+}
+
+// Backend wraps a backend with a key cache.
+type Backend struct {
+	backend.BackendV1
+	opts Options
+
+	mu      sync.Mutex
+	loaded  bool
+	path    string
+	entries map[fileID]entry
+	seq     int
+	logged  int
+}
+
+// Wrap returns a backend that behaves like b but caches the keys it generates as described in the
+// package documentation.
+func Wrap(b backend.BackendV1, opts Options) *Backend {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = DefaultMaxEntries
+	}
+	return &Backend{BackendV1: b, opts: opts}
+}
+
+// Unwrap returns the wrapped backend.
+func (b *Backend) Unwrap() backend.BackendV1 {
+	return b.BackendV1
+}
+
+// racyWindow is how recently a file may have been modified for its key not to be cached, since
+// modifications made within the resolution of the file system's timestamps would go unnoticed.
+const racyWindow = 2 * time.Second
+
+// GenKey returns the cached key for the file if it is unchanged and otherwise asks the wrapped
+// backend.
+func (b *Backend) GenKey(a backend.Annex, file string) (string, bool, error) {
+	name, fields, err := b.GenKeyV2(a, file)
+	return name, fields.Size, err
+}
+
+// GenKeyV2 is like GenKey, but also passes on the other fields requested by a wrapped backend that
+// implements backend.HasGenKeyV2.
+func (b *Backend) GenKeyV2(a backend.Annex, file string) (string, backend.KeyFields, error) {
+	if !b.BackendV1.IsStable(a) {
+		return backend.GenKeyFields(a, b.BackendV1, file)
+	}
+	id, ok := statFile(file)
+	if !ok {
+		return backend.GenKeyFields(a, b.BackendV1, file)
+	}
+
+	b.mu.Lock()
+	b.load(a)
+	e, hit := b.entries[id]
+	b.mu.Unlock()
+	if hit {
+		a.Debugf("using cached key for %s", file)
+		return e.name, e.fields, nil
+	}
+
+	name, fields, err := backend.GenKeyFields(a, b.BackendV1, file)
+	if err != nil {
+		return "", fields, err
+	}
+	// Only cache the key if the file did not change while it was being generated and is not so
+	// recently modified that a further change might not be detected.
+	if after, ok := statFile(file); !ok || after != id || time.Since(time.Unix(0, id.mtime)) < racyWindow {
+		return name, fields, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	e = entry{name: name, fields: fields, seq: b.seq}
+	b.entries[id] = e
+	if err := b.appendLine(formatEntry(id, e)); err != nil {
+		// The cache is only an optimization, so failing to update it should not fail the operation.
+		a.Debugf("updating key cache: %v", err)
+	}
+	return name, fields, nil
+}
+
+// load reads the cache the first time it is called. It must be called with b.mu held.
+func (b *Backend) load(a backend.Annex) {
+	if b.loaded {
+		return
+	}
+	b.loaded = true
+	b.entries = make(map[fileID]entry)
+
+	path, err := b.opts.path()
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0o700)
+	}
+	if err != nil {
+		a.Debugf("not caching keys: %v", err)
+		return
+	}
+	b.path = path
+	if err := b.read(); err != nil {
+		a.Debugf("loading key cache: %v", err)
+	}
+	if len(b.entries) > b.opts.MaxEntries || b.logged > 2*len(b.entries)+1000 {
+		if err := b.compact(); err != nil {
+			a.Debugf("compacting key cache: %v", err)
+		}
+	}
+}
+
+// Each line of the log has the form "<dev> <inode> <size> <mtime> <fields> <name>", where mtime is
+// in nanoseconds since the Unix epoch and fields is the sum of 1 if the key includes the size and 2
+// if it includes the modification time. Later lines override earlier ones.
+
+const (
+	fieldSize = 1 << iota
+	fieldMtime
+)
+
+func formatEntry(id fileID, e entry) string {
+	fields := 0
+	if e.fields.Size {
+		fields |= fieldSize
+	}
+	if e.fields.Mtime {
+		fields |= fieldMtime
+	}
+	return fmt.Sprintf("%d %d %d %d %d %s", id.dev, id.ino, id.size, id.mtime, fields, e.name)
+}
+
+func parseEntry(line string) (fileID, entry, bool) {
+	var id fileID
+	var e entry
+	fields := strings.SplitN(line, " ", 6)
+	if len(fields) != 6 || fields[5] == "" {
+		return id, e, false
+	}
+	var err [5]error
+	var keyFields uint64
+	id.dev, err[0] = strconv.ParseUint(fields[0], 10, 64)
+	id.ino, err[1] = strconv.ParseUint(fields[1], 10, 64)
+	id.size, err[2] = strconv.ParseInt(fields[2], 10, 64)
+	id.mtime, err[3] = strconv.ParseInt(fields[3], 10, 64)
+	keyFields, err[4] = strconv.ParseUint(fields[4], 10, 8)
+	for _, err := range err {
+		if err != nil {
+			return id, e, false
+		}
+	}
+	e.fields = backend.KeyFields{Size: keyFields&fieldSize != 0, Mtime: keyFields&fieldMtime != 0}
+	e.name = fields[5]
+	return id, e, true
+}
+
+func (b *Backend) read() error {
+	f, err := os.Open(b.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		id, e, ok := parseEntry(s.Text())
+		if !ok {
+			// Probably a line cut short by a crash; skip it.
+			continue
+		}
+		b.seq++
+		b.logged++
+		e.seq = b.seq
+		b.entries[id] = e
+	}
+	return s.Err()
+}
+
+func (b *Backend) appendLine(line string) error {
+	if b.path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(b.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		f.Close()
+		return err
+	}
+	b.logged++
+	return f.Close()
+}
+
+// compact rewrites the log so that it contains only one line per file, keeping only the most
+// recent MaxEntries entries.
+func (b *Backend) compact() error {
+	type idEntry struct {
+		id fileID
+		e  entry
+	}
+	all := make([]idEntry, 0, len(b.entries))
+	for id, e := range b.entries {
+		all = append(all, idEntry{id, e})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].e.seq < all[j].e.seq })
+	if len(all) > b.opts.MaxEntries {
+		for _, ie := range all[:len(all)-b.opts.MaxEntries] {
+			delete(b.entries, ie.id)
+		}
+		all = all[len(all)-b.opts.MaxEntries:]
+	}
+
+	tmp := b.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, ie := range all {
+		fmt.Fprintln(w, formatEntry(ie.id, ie.e))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		return err
+	}
+	b.logged = len(all)
+	return nil
+}
+
+// Statically ensure that the wrapper satisfies the interfaces used by the library.
+var (
+	_ backend.BackendV1   = (*Backend)(nil)
+	_ backend.HasGenKeyV2 = (*Backend)(nil)
+	_ backend.Unwrapper   = (*Backend)(nil)
+)
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package cache
+
+// statFile reports that files cannot be identified, since the system does not report inode
+// numbers through os.Stat.
+func statFile(file string) (fileID, bool) {
+	return fileID{}, false
+}
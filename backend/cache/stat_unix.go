@@ -0,0 +1,27 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package cache
+
+import (
+	"os"
+	"syscall"
+)
+
+// statFile returns the identity of the current version of the file, if the system reports one.
+func statFile(file string) (fileID, bool) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return fileID{}, false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+	return fileID{
+		dev:   uint64(st.Dev),
+		ino:   uint64(st.Ino),
+		size:  fi.Size(),
+		mtime: fi.ModTime().UnixNano(),
+	}, true
+}
@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dzhu/go-git-annex-external/cdc"
+)
+
+// CDCBackend is a backend that splits the content of files into content-defined chunks (see the
+// cdc package) and names keys by the hash of the list of the hashes of the chunks, so that files
+// sharing most of their content have manifests sharing most of their chunks. With the same hash
+// and chunk parameters, the chunks are the same as those stored by the remote/dedup wrapper.
+//
+// For example, a program calling
+//
+//	backend.Run(&backend.CDCBackend{New: sha256.New, Secure: true})
+//
+// and installed as git-annex-backend-XCDC provides a content-defined chunking backend named XCDC.
+type CDCBackend struct {
+	// New returns a new hash, used both for the chunks and for the list of their hashes; it is
+	// required.
+	New func() hash.Hash
+	// Params are the chunk sizes. If they are zero, cdc.DefaultParams are used. Since the name of a
+	// key depends on the chunk sizes, a backend must keep them fixed for its keys to remain stable.
+	Params cdc.Params
+	// Encode converts a hash sum into the name of a key. If it is nil, the sum is hex-encoded.
+	Encode func(sum []byte) string
+	// Secure indicates whether the hash is cryptographically secure.
+	Secure bool
+	// OmitSize omits the size field from keys.
+	OmitSize bool
+	// Extensions includes the extensions of files in keys (see HasExtensionKeys).
+	Extensions bool
+	// ManifestDir, if it is not empty, is a directory into which GenKey writes the manifest of
+	// each file it generates a key for, in a file named by the name of the key.
+	ManifestDir string
+}
+
+// IsStable returns true, since the name of a key depends only on the content of the file.
+func (c *CDCBackend) IsStable(a Annex) bool {
+	return true
+}
+
+// GenKey computes the manifest of the file, writing it to ManifestDir if that is set.
+func (c *CDCBackend) GenKey(a Annex, file string) (string, bool, error) {
+	name, m, err := c.Hash(a, file)
+	if err != nil {
+		return "", false, err
+	}
+	if c.ManifestDir != "" {
+		if err := c.writeManifest(name, m); err != nil {
+			return "", false, err
+		}
+	}
+	return name, !c.OmitSize, nil
+}
+
+func (c *CDCBackend) writeManifest(name string, m cdc.Manifest) error {
+	if err := os.MkdirAll(c.ManifestDir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(c.ManifestDir, ".manifest-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := m.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(c.ManifestDir, name))
+}
+
+// VerifyKeyContent computes the manifest of the file and compares its hash with the name of the
+// key.
+func (c *CDCBackend) VerifyKeyContent(a Annex, name, file string) bool {
+	ok, err := c.VerifyKeyContentV2(a, name, file)
+	return err == nil && ok
+}
+
+// VerifyKeyContentV2 computes the manifest of the file and compares its hash with the name of the
+// key, returning an error if the file cannot be read.
+func (c *CDCBackend) VerifyKeyContentV2(a Annex, name, file string) (bool, error) {
+	got, _, err := c.Hash(a, file)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(name)) == 1, nil
+}
+
+// IsCryptographicallySecure returns the value of the Secure field.
+func (c *CDCBackend) IsCryptographicallySecure(a Annex) bool {
+	return c.Secure
+}
+
+// ExtensionKeys returns the value of the Extensions field.
+func (c *CDCBackend) ExtensionKeys(a Annex) bool {
+	return c.Extensions
+}
+
+// Hash splits the file into chunks, reporting progress to a, and returns the encoded hash of the
+// resulting manifest along with the manifest.
+func (c *CDCBackend) Hash(a Annex, file string) (string, cdc.Manifest, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	params := c.Params
+	if params == (cdc.Params{}) {
+		params = cdc.DefaultParams
+	}
+	h := c.New()
+	m, err := cdc.Build(io.TeeReader(f, &progressWriter{w: ioutil.Discard, a: a}), params, h, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := m.Sum(h)
+	if c.Encode == nil {
+		return hex.EncodeToString(sum), m, nil
+	}
+	return c.Encode(sum), m, nil
+}
+
+// Statically ensure that the backend satisfies the interfaces used by the library.
+var (
+	_ BackendV1             = (*CDCBackend)(nil)
+	_ HasVerifyKeyContent   = (*CDCBackend)(nil)
+	_ HasVerifyKeyContentV2 = (*CDCBackend)(nil)
+	_ HasExtensionKeys      = (*CDCBackend)(nil)
+)
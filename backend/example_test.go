@@ -0,0 +1,55 @@
+package backend_test
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/dzhu/go-git-annex-external/backend"
+)
+
+// shortHashBackend names keys by the first four bytes of the SHA512 hash of the content.
+type shortHashBackend struct{}
+
+func (h *shortHashBackend) IsStable(a backend.Annex) bool {
+	return true
+}
+
+func (h *shortHashBackend) GenKey(a backend.Annex, file string) (string, bool, error) {
+	hasher := sha512.New()
+	f, err := os.Open(file)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", false, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)[:4]), true, nil
+}
+
+func (h *shortHashBackend) VerifyKeyContent(a backend.Annex, key, file string) bool {
+	key2, _, err := h.GenKey(a, file)
+	return err == nil && key == key2
+}
+
+func (h *shortHashBackend) IsCryptographicallySecure(a backend.Annex) bool {
+	return false
+}
+
+// This example implements a backend from scratch. Backends that only hash the content of files can
+// use HashBackend instead, as in its example.
+func Example() {
+	backend.Run(&shortHashBackend{})
+}
+
+func ExampleHashBackend() {
+	backend.Run(&backend.HashBackend{
+		New: sha512.New,
+		Encode: func(sum []byte) string {
+			return hex.EncodeToString(sum[:4])
+		},
+	})
+}
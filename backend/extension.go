@@ -0,0 +1,62 @@
+package backend
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Limits on the extensions included in keys, matching the defaults of git-annex's
+// annex.maxextensions and annex.maxextensionlength settings.
+const (
+	maxExtensions      = 2
+	maxExtensionLength = 4
+)
+
+// extensionKeys reports whether b includes the extensions of files in its keys.
+func extensionKeys(a Annex, b BackendV1) bool {
+	var h HasExtensionKeys
+	return As(b, &h) && h.ExtensionKeys(a)
+}
+
+// keyExtension returns the extension of file to include in a key, with its leading dot, or the
+// empty string if there is none. It selects the extension in the same way as git-annex does for
+// its "E" backends.
+func keyExtension(file string) string {
+	base := filepath.Base(file)
+	i := strings.IndexByte(base, '.')
+	if i < 0 {
+		return ""
+	}
+	// Working back from the last extension, stop at the first one that is too long, then keep the
+	// last few of the remaining ones that contain only valid characters.
+	parts := strings.Split(base[i+1:], ".")
+	var exts []string
+	for j := len(parts) - 1; j >= 0 && len(parts[j]) <= maxExtensionLength; j-- {
+		if validExtension(parts[j]) {
+			exts = append(exts, parts[j])
+		}
+	}
+	if len(exts) > maxExtensions {
+		exts = exts[:maxExtensions]
+	}
+	var b strings.Builder
+	for j := len(exts) - 1; j >= 0; j-- {
+		if exts[j] != "" {
+			b.WriteString(".")
+			b.WriteString(exts[j])
+		}
+	}
+	return b.String()
+}
+
+// validExtension reports whether ext contains only characters that git-annex allows in
+// extensions: ASCII letters and digits, and non-ASCII bytes.
+func validExtension(ext string) bool {
+	for i := 0; i < len(ext); i++ {
+		c := ext[i]
+		if c < 0x80 && !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package backend
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+)
+
+// HashBackend is a backend that names keys by a hash of the content of files. It reads each file
+// once, reporting progress to git-annex as it does so, and verifies content by hashing it again and
+// comparing the result in constant time.
+type HashBackend struct {
+	// New returns a new hash; it is required.
+	New func() hash.Hash
+	// Encode converts a hash sum into the name of a key. If it is nil, the sum is hex-encoded.
+	Encode func(sum []byte) string
+	// Secure indicates whether the hash is cryptographically secure.
+	Secure bool
+	// OmitSize omits the size field from keys.
+	OmitSize bool
+	// Extensions includes the extensions of files in keys (see HasExtensionKeys).
+	Extensions bool
+}
+
+// IsStable returns true, since the name of a key depends only on the content of the file.
+func (h *HashBackend) IsStable(a Annex) bool {
+	return true
+}
+
+// GenKey hashes the file.
+func (h *HashBackend) GenKey(a Annex, file string) (string, bool, error) {
+	name, err := h.Hash(a, file)
+	if err != nil {
+		return "", false, err
+	}
+	return name, !h.OmitSize, nil
+}
+
+// VerifyKeyContent hashes the file and compares the result with the name of the key.
+func (h *HashBackend) VerifyKeyContent(a Annex, name, file string) bool {
+	ok, err := h.VerifyKeyContentV2(a, name, file)
+	return err == nil && ok
+}
+
+// VerifyKeyContentV2 hashes the file and compares the result with the name of the key, returning
+// an error if the file cannot be read.
+func (h *HashBackend) VerifyKeyContentV2(a Annex, name, file string) (bool, error) {
+	got, err := h.Hash(a, file)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(name)) == 1, nil
+}
+
+// IsCryptographicallySecure returns the value of the Secure field.
+func (h *HashBackend) IsCryptographicallySecure(a Annex) bool {
+	return h.Secure
+}
+
+// ExtensionKeys returns the value of the Extensions field.
+func (h *HashBackend) ExtensionKeys(a Annex) bool {
+	return h.Extensions
+}
+
+// Hash returns the encoded hash of the content of the file, reporting progress to a.
+func (h *HashBackend) Hash(a Annex, file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := h.New()
+	if _, err := io.Copy(&progressWriter{w: hasher, a: a}, f); err != nil {
+		return "", err
+	}
+	sum := hasher.Sum(nil)
+	if h.Encode == nil {
+		return hex.EncodeToString(sum), nil
+	}
+	return h.Encode(sum), nil
+}
+
+// progressWriter reports the number of bytes written through it as progress, at most once per
+// progressInterval bytes.
+type progressWriter struct {
+	w        io.Writer
+	a        Annex
+	written  int64
+	reported int64
+}
+
+const progressInterval = 1 << 20
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	if p.written-p.reported >= progressInterval {
+		p.a.Progress(int(p.written))
+		p.reported = p.written
+	}
+	return n, err
+}
+
+// Statically ensure that the backend satisfies the interfaces used by the library.
+var (
+	_ BackendV1             = (*HashBackend)(nil)
+	_ HasVerifyKeyContent   = (*HashBackend)(nil)
+	_ HasVerifyKeyContentV2 = (*HashBackend)(nil)
+	_ HasExtensionKeys      = (*HashBackend)(nil)
+)
@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/dzhu/go-git-annex-external/key"
+)
+
+// Migrator computes the keys of files under a new backend, for moving a repository from one backend
+// to another as `git annex migrate` does. Before generating the new key for a file, it checks that
+// the file matches its key under the old backend, so that content that has been corrupted, or that
+// the old backend does not generate keys for consistently, is not given a new key that would hide
+// the problem.
+//
+// Backends are identified by their names as they appear in keys, which for external backends
+// includes the "X" prefix, such as XSHORTHASH; a HashBackend using sha256.New may stand in for
+// git-annex's native SHA256 backend, since it generates the same keys.
+type Migrator struct {
+	// Old is the backend the files currently have keys from, and OldName is its name.
+	Old     BackendV1
+	OldName string
+	// New is the backend to generate keys with, and NewName is its name.
+	New     BackendV1
+	NewName string
+	// Workers is the number of files processed in parallel. If it is zero, the number of CPUs is
+	// used.
+	Workers int
+	// Annex receives the progress and debug messages sent by the backends, from several goroutines
+	// at once. If it is nil, they are discarded.
+	Annex Annex
+}
+
+// Migration is the result of migrating one file.
+type Migration struct {
+	File   string
+	OldKey string
+	NewKey string
+	// Err is set if the file could not be migrated, in which case NewKey is empty and OldKey may
+	// be.
+	Err error
+}
+
+// ErrContentMismatch is returned, wrapped, for a file that does not match its old key.
+var ErrContentMismatch = errors.New("content does not match key")
+
+// Migrate migrates one file.
+//
+// If the file is a symlink to an annexed object, as git-annex creates for locked files, the old key
+// is the name of the object, and the content is checked against it with the old backend's
+// verification, which the old backend must therefore support. Otherwise, the old key is generated
+// from the content of the file, which requires the old backend to be stable.
+func (m *Migrator) Migrate(file string) Migration {
+	mig := Migration{File: file}
+	a := m.annex()
+	var err error
+	if mig.OldKey, err = m.oldKey(a, file); err != nil {
+		mig.Err = err
+		return mig
+	}
+	if mig.NewKey, err = makeKey(a, m.New, m.NewName, file); err != nil {
+		mig.Err = fmt.Errorf("generating new key: %w", err)
+	}
+	return mig
+}
+
+func (m *Migrator) oldKey(a Annex, file string) (string, error) {
+	if target, err := os.Readlink(file); err == nil {
+		k := filepath.Base(target)
+		parsed, err := key.Parse(k)
+		if err != nil {
+			return "", fmt.Errorf("symlink does not point to an annexed object: %w", err)
+		}
+		if parsed.Backend != m.OldName {
+			return k, fmt.Errorf("key %s is not from backend %s", k, m.OldName)
+		}
+		ok, err := checkKey(a, m.Old, k, file)
+		if err != nil {
+			return k, err
+		}
+		if !ok {
+			return k, fmt.Errorf("%s: %w", k, ErrContentMismatch)
+		}
+		return k, nil
+	}
+
+	if !m.Old.IsStable(a) {
+		return "", errors.New("file is not an annexed symlink and the old backend is not stable")
+	}
+	k, err := makeKey(a, m.Old, m.OldName, file)
+	if err != nil {
+		return "", fmt.Errorf("generating old key: %w", err)
+	}
+	return k, nil
+}
+
+// MigrateAll migrates the files in parallel and returns the results in the same order.
+func (m *Migrator) MigrateAll(files []string) []Migration {
+	results := make([]Migration, len(files))
+	workers := m.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				results[i] = m.Migrate(files[i])
+			}
+		}()
+	}
+	for i := range files {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return results
+}
+
+func (m *Migrator) annex() Annex {
+	if m.Annex != nil {
+		return m.Annex
+	}
+	return discardAnnex{}
+}
+
+// discardAnnex discards everything sent to it.
+type discardAnnex struct{}
+
+func (discardAnnex) Progress(bytes int)                     {}
+func (discardAnnex) Debug(message string)                   {}
+func (discardAnnex) Debugf(fmt string, args ...interface{}) {}
+func (discardAnnex) Error(message string)                   {}
+func (discardAnnex) Errorf(fmt string, args ...interface{}) {}
@@ -0,0 +1,219 @@
+package backend
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"runtime"
+)
+
+// DefaultTreeChunkSize is the chunk size used by TreeHashBackend if none is given.
+const DefaultTreeChunkSize = 1 << 20
+
+// TreeHashBackend is a backend that names keys by a tree hash of the content of files, which it
+// computes by hashing the chunks of each file in parallel. This makes generating keys for very
+// large files much faster than with a backend that hashes files sequentially, such as HashBackend.
+//
+// The tree hash of a file is computed with the hash returned by New as follows:
+//
+//   - The content is split into chunks of ChunkSize bytes; the last chunk may be shorter. An empty
+//     file has a single empty chunk.
+//   - The hash of each chunk is the hash of the byte 0x00 followed by the chunk.
+//   - The list of hashes is reduced to a single hash by repeatedly replacing each successive pair
+//     of hashes with the hash of the byte 0x01 followed by the two hashes. If the list has an odd
+//     length, its last hash is carried over to the next level unchanged.
+//
+// The name of the key is the final hash, encoded with Encode. Since the tree hash depends on the
+// chunk size, a backend must keep its chunk size fixed for its keys to remain stable.
+//
+// For example, a program calling
+//
+//	backend.Run(&backend.TreeHashBackend{New: sha256.New, Secure: true})
+//
+// and installed as git-annex-backend-XTREEHASH provides a tree hash backend named XTREEHASH.
+type TreeHashBackend struct {
+	// New returns a new hash; it is required.
+	New func() hash.Hash
+	// ChunkSize is the size of the chunks that are hashed independently. If it is zero,
+	// DefaultTreeChunkSize is used.
+	ChunkSize int64
+	// Workers is the number of chunks hashed in parallel. If it is zero, the number of CPUs is used.
+	Workers int
+	// Encode converts a hash sum into the name of a key. If it is nil, the sum is hex-encoded.
+	Encode func(sum []byte) string
+	// Secure indicates whether the hash is cryptographically secure.
+	Secure bool
+	// OmitSize omits the size field from keys.
+	OmitSize bool
+	// Extensions includes the extensions of files in keys (see HasExtensionKeys).
+	Extensions bool
+}
+
+// Prefixes distinguishing the hashes of chunks from the hashes of pairs of hashes.
+const (
+	treeLeafPrefix = 0x00
+	treeNodePrefix = 0x01
+)
+
+// IsStable returns true, since the name of a key depends only on the content of the file.
+func (t *TreeHashBackend) IsStable(a Annex) bool {
+	return true
+}
+
+// GenKey computes the tree hash of the file.
+func (t *TreeHashBackend) GenKey(a Annex, file string) (string, bool, error) {
+	name, err := t.Hash(a, file)
+	if err != nil {
+		return "", false, err
+	}
+	return name, !t.OmitSize, nil
+}
+
+// VerifyKeyContent computes the tree hash of the file and compares it with the name of the key.
+func (t *TreeHashBackend) VerifyKeyContent(a Annex, name, file string) bool {
+	ok, err := t.VerifyKeyContentV2(a, name, file)
+	return err == nil && ok
+}
+
+// VerifyKeyContentV2 computes the tree hash of the file and compares it with the name of the key,
+// returning an error if the file cannot be read.
+func (t *TreeHashBackend) VerifyKeyContentV2(a Annex, name, file string) (bool, error) {
+	got, err := t.Hash(a, file)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(name)) == 1, nil
+}
+
+// IsCryptographicallySecure returns the value of the Secure field.
+func (t *TreeHashBackend) IsCryptographicallySecure(a Annex) bool {
+	return t.Secure
+}
+
+// ExtensionKeys returns the value of the Extensions field.
+func (t *TreeHashBackend) ExtensionKeys(a Annex) bool {
+	return t.Extensions
+}
+
+// Hash returns the encoded tree hash of the content of the file, reporting progress to a.
+func (t *TreeHashBackend) Hash(a Annex, file string) (string, error) {
+	sum, err := t.Sum(a, file)
+	if err != nil {
+		return "", err
+	}
+	if t.Encode == nil {
+		return hex.EncodeToString(sum), nil
+	}
+	return t.Encode(sum), nil
+}
+
+// Sum returns the tree hash of the content of the file, reporting progress to a.
+func (t *TreeHashBackend) Sum(a Annex, file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	chunkSize := t.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultTreeChunkSize
+	}
+	n := int((stat.Size() + chunkSize - 1) / chunkSize)
+	if n == 0 {
+		n = 1
+	}
+	workers := t.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > n {
+		workers = n
+	}
+
+	type result struct {
+		bytes int
+		err   error
+	}
+	leaves := make([][]byte, n)
+	indices := make(chan int)
+	results := make(chan result)
+	for w := 0; w < workers; w++ {
+		go func() {
+			buf := make([]byte, chunkSize)
+			h := t.New()
+			for i := range indices {
+				m, err := f.ReadAt(buf, int64(i)*chunkSize)
+				if err == io.EOF {
+					err = nil
+				}
+				if err == nil {
+					h.Reset()
+					h.Write([]byte{treeLeafPrefix})
+					h.Write(buf[:m])
+					leaves[i] = h.Sum(nil)
+				}
+				results <- result{m, err}
+			}
+		}()
+	}
+
+	// Hand out the chunks and collect the results on this goroutine, which alone reports progress.
+	go func() {
+		for i := 0; i < n; i++ {
+			indices <- i
+		}
+		close(indices)
+	}()
+	var done, reported int64
+	var firstErr error
+	for i := 0; i < n; i++ {
+		r := <-results
+		if r.err != nil && firstErr == nil {
+			firstErr = r.err
+		}
+		done += int64(r.bytes)
+		if done-reported >= progressInterval {
+			a.Progress(int(done))
+			reported = done
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return t.reduce(leaves), nil
+}
+
+// reduce combines the hashes of the chunks into the tree hash.
+func (t *TreeHashBackend) reduce(level [][]byte) []byte {
+	h := t.New()
+	for len(level) > 1 {
+		next := level[:0]
+		for i := 0; i+1 < len(level); i += 2 {
+			h.Reset()
+			h.Write([]byte{treeNodePrefix})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		if len(level)%2 == 1 {
+			next = append(next, level[len(level)-1])
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// Statically ensure that the backend satisfies the interfaces used by the library.
+var (
+	_ BackendV1             = (*TreeHashBackend)(nil)
+	_ HasVerifyKeyContent   = (*TreeHashBackend)(nil)
+	_ HasVerifyKeyContentV2 = (*TreeHashBackend)(nil)
+	_ HasExtensionKeys      = (*TreeHashBackend)(nil)
+)
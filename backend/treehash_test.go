@@ -0,0 +1,46 @@
+package backend_test
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/dzhu/go-git-annex-external/backend"
+	"github.com/dzhu/go-git-annex-external/backend/backendtest"
+)
+
+// TestTreeHashGolden pins the tree hash to keys computed independently from its documented
+// definition, so that a change to the hash, which would change the keys of existing content, is
+// noticed.
+func TestTreeHashGolden(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		content, key string
+	}{
+		// A single empty chunk.
+		{"", "XTREE-s0--6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d"},
+		// A single short chunk.
+		{"abc", "XTREE-s3--609f6e36d2405585188d5cfd761f407c7cc46a7d3f314c88270469dde315fcd1"},
+		// Three chunks, the last of which is carried over to the second level.
+		{"abcdefghij", "XTREE-s10--2a5b33d54d89d05737a7dd798d9862d55951564aafb5460691ad8a7a9ab6c678"},
+		// Five chunks over three levels.
+		{"abcdefghijklmnopq", "XTREE-s17--5025f84dd0065fe0ae1ed0669d11a81d6d02b7a5e74b035817d89b390e4b07cd"},
+	} {
+		file := filepath.Join(dir, "file")
+		if err := ioutil.WriteFile(file, []byte(tc.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		for _, workers := range []int{1, 3} {
+			h := backendtest.Start(&backend.TreeHashBackend{New: sha256.New, ChunkSize: 4, Workers: workers}, "TREE")
+			k, err := h.GenKey(file)
+			h.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k != tc.key {
+				t.Errorf("%q with %d workers: GenKey = %q, want %q", tc.content, workers, k, tc.key)
+			}
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package backend
+
+import "reflect"
+
+// Unwrapper is implemented by backends that wrap another backend to add behavior to it, such as
+// caching. When git-annex sends a message handled by one of the optional "Has*" interfaces, the
+// first backend in the chain formed by successive calls to Unwrap that implements the interface
+// handles it, so a wrapper only needs to implement the optional interfaces whose behavior it
+// changes.
+type Unwrapper interface {
+	Unwrap() BackendV1
+}
+
+// As finds the first backend in the chain starting at b that implements the interface pointed to
+// by target and, if there is one, sets target to that backend and returns true. The chain consists
+// of b followed by the backends obtained by repeatedly calling Unwrap. It panics if target is not a
+// non-nil pointer to an interface type.
+func As(b BackendV1, target interface{}) bool {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Interface {
+		panic("backend.As: target must be a non-nil pointer to an interface type")
+	}
+	t := v.Elem().Type()
+	for b != nil {
+		if reflect.TypeOf(b).Implements(t) {
+			v.Elem().Set(reflect.ValueOf(b))
+			return true
+		}
+		u, ok := b.(Unwrapper)
+		if !ok {
+			break
+		}
+		b = u.Unwrap()
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+// Package cdc splits content into content-defined chunks with the FastCDC algorithm and describes
+// the result with manifests. It is shared by backend.CDCBackend, which names keys by the chunks of
+// files, and the remote/dedup wrapper, which stores each distinct chunk only once.
+//
+// Content-defined chunk boundaries are chosen by a rolling hash of the content rather than at fixed
+// offsets, so inserting or deleting bytes in the middle of a file changes only the chunks around
+// the edit; the chunks of two files that are largely the same are largely shared.
+//
+// The boundaries depend only on the content and the Params, so the same content is always split
+// the same way with the same Params. The table used by the rolling hash is fixed and will not
+// change.
+package cdc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Params are the chunk sizes used by a Chunker. Every chunk is at least Min bytes and at most Max
+// bytes, except the last chunk of the content, which may be shorter than Min; chunk sizes are
+// distributed around Avg.
+type Params struct {
+	Min, Avg, Max int
+}
+
+// MinAvgSize is the smallest allowed value of Params.Avg.
+const MinAvgSize = 64
+
+// DefaultParams are suitable for large files such as disk images and datasets.
+var DefaultParams = ParamsForAverage(1 << 20)
+
+// ParamsForAverage returns Params with the given average size and the minimum and maximum sizes
+// recommended for FastCDC: a quarter and four times the average.
+func ParamsForAverage(avg int) Params {
+	return Params{Min: avg / 4, Avg: avg, Max: avg * 4}
+}
+
+// Validate checks that the sizes are consistent.
+func (p Params) Validate() error {
+	switch {
+	case p.Avg < MinAvgSize:
+		return fmt.Errorf("average chunk size %d is less than %d", p.Avg, MinAvgSize)
+	case p.Min <= 0 || p.Min > p.Avg:
+		return fmt.Errorf("minimum chunk size %d is not between 1 and the average size %d", p.Min, p.Avg)
+	case p.Max < p.Avg:
+		return fmt.Errorf("maximum chunk size %d is less than the average size %d", p.Max, p.Avg)
+	}
+	return nil
+}
+
+// masks returns the masks tested against the rolling hash before and after a chunk reaches the
+// average size. Following FastCDC's normalized chunking, the first mask has two more bits than
+// would give the average size and the second has two fewer, which narrows the distribution of chunk
+// sizes. The masks use the high bits of the hash, which depend on the most bytes.
+func (p Params) masks() (small, large uint64) {
+	n := bits.Len(uint(p.Avg)) - 1
+	return ^uint64(0) << (64 - (n + 2)), ^uint64(0) << (64 - (n - 2))
+}
+
+// gear is the table of random values used by the rolling hash, generated by SplitMix64 from a
+// fixed seed. Changing it would change the chunks of all content.
+var gear = func() (t [256]uint64) {
+	var x uint64
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
+
+// Chunker splits the content of a reader into chunks.
+type Chunker struct {
+	r            io.Reader
+	p            Params
+	small, large uint64
+
+	buf        []byte
+	start, end int
+	eof        bool
+}
+
+// NewChunker returns a chunker that splits the content of r using the given parameters, which must
+// be valid.
+func NewChunker(r io.Reader, p Params) (*Chunker, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	small, large := p.masks()
+	return &Chunker{r: r, p: p, small: small, large: large, buf: make([]byte, p.Max)}, nil
+}
+
+// Next returns the next chunk of the content, or io.EOF if there are no more chunks. Empty content
+// has no chunks. The returned slice is only valid until the next call to Next.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.end-c.start < c.p.Max && !c.eof {
+		if err := c.fill(); err != nil {
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	data := c.buf[c.start:c.end]
+	n := c.cut(data)
+	c.start += n
+	return data[:n], nil
+}
+
+// fill moves the unconsumed data to the start of the buffer and reads until the buffer is full or
+// the reader is exhausted.
+func (c *Chunker) fill() error {
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	for c.end < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if errors.Is(err, io.EOF) {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cut returns the length of the chunk at the start of data, which holds at least Max bytes unless
+// it is the end of the content.
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.p.Min {
+		return n
+	}
+	if n > c.p.Max {
+		n = c.p.Max
+	}
+	normal := c.p.Avg
+	if normal > n {
+		normal = n
+	}
+	var h uint64
+	i := c.p.Min
+	for ; i < normal; i++ {
+		h = h<<1 + gear[data[i]]
+		if h&c.small == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = h<<1 + gear[data[i]]
+		if h&c.large == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
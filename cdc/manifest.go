@@ -0,0 +1,117 @@
+package cdc
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Chunk describes one chunk of content.
+type Chunk struct {
+	Size int64
+	// Sum is the hash of the chunk.
+	Sum []byte
+}
+
+// Manifest lists the chunks of some content in order.
+//
+// In text form, a manifest is the line ManifestHeader followed by a line "<size> <hex sum>" for
+// each chunk.
+type Manifest []Chunk
+
+// ManifestHeader is the first line of a manifest in text form.
+const ManifestHeader = "cdc-manifest 1"
+
+// Build splits the content of r into chunks and returns the manifest listing their hashes, computed
+// with h. If fn is not nil, it is called with each chunk, which is only valid during the call,
+// after the chunk is hashed.
+func Build(r io.Reader, p Params, h hash.Hash, fn func(data []byte, c Chunk) error) (Manifest, error) {
+	chunker, err := NewChunker(r, p)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	for {
+		data, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		h.Reset()
+		h.Write(data)
+		c := Chunk{Size: int64(len(data)), Sum: h.Sum(nil)}
+		m = append(m, c)
+		if fn != nil {
+			if err := fn(data, c); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Size returns the total size of the chunks.
+func (m Manifest) Size() int64 {
+	var size int64
+	for _, c := range m {
+		size += c.Size
+	}
+	return size
+}
+
+// Sum returns the hash, computed with h, of the concatenated hashes of the chunks. It identifies
+// the content as well as the hashes of the chunks do.
+func (m Manifest) Sum(h hash.Hash) []byte {
+	h.Reset()
+	for _, c := range m {
+		h.Write(c.Sum)
+	}
+	return h.Sum(nil)
+}
+
+// WriteTo writes the manifest in text form.
+func (m Manifest) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var written int64
+	n, _ := fmt.Fprintln(bw, ManifestHeader)
+	written += int64(n)
+	for _, c := range m {
+		n, _ := fmt.Fprintf(bw, "%d %s\n", c.Size, hex.EncodeToString(c.Sum))
+		written += int64(n)
+	}
+	return written, bw.Flush()
+}
+
+// ReadManifest reads a manifest in text form.
+func ReadManifest(r io.Reader) (Manifest, error) {
+	s := bufio.NewScanner(r)
+	if !s.Scan() || s.Text() != ManifestHeader {
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("not a chunk manifest")
+	}
+	var m Manifest
+	for line := 2; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("manifest line %d: expected size and hash", line)
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("manifest line %d: invalid size %q", line, fields[0])
+		}
+		sum, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("manifest line %d: invalid hash %q", line, fields[1])
+		}
+		m = append(m, Chunk{Size: size, Sum: sum})
+	}
+	return m, s.Err()
+}
@@ -0,0 +1,60 @@
+// Command clear-backend-cache deletes the key caches kept by external backends that use the
+// backend/cache package.
+//
+// Usage:
+//
+//	clear-backend-cache [-dir directory] [name ...]
+//
+// With names, only the caches of the named backends are deleted; the name of a backend's cache is
+// the name given in its cache.Options, which defaults to the name of its program, such as
+// git-annex-backend-XSHORTHASH. Without names, the caches of all backends in the directory are
+// deleted.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dzhu/go-git-annex-external/backend/cache"
+)
+
+func main() {
+	dir := flag.String("dir", "", "the cache directory (default: the user's cache directory)")
+	flag.Parse()
+
+	names := flag.Args()
+	if len(names) == 0 {
+		d := *dir
+		if d == "" {
+			var err error
+			if d, err = cache.DefaultDir(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		// Only delete the files that look like caches, in case the directory holds anything else.
+		logs, err := filepath.Glob(filepath.Join(d, "*.log"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, log := range logs {
+			names = append(names, strings.TrimSuffix(filepath.Base(log), ".log"))
+		}
+		*dir = d
+	}
+
+	failed := false
+	for _, name := range names {
+		if err := cache.Clear(cache.Options{Name: name, Dir: *dir}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,12 @@
+// Command git-annex-backend-XCDC is an external backend for git-annex that computes keys from the
+// SHA-256 hashes of the content-defined chunks of a file. See the backends package for details.
+package main
+
+import (
+	"github.com/dzhu/go-git-annex-external/backend"
+	"github.com/dzhu/go-git-annex-external/backend/backends"
+)
+
+func main() {
+	backend.Run(backends.CDC())
+}
@@ -0,0 +1,13 @@
+// Command git-annex-backend-XCRC64 is an external backend for git-annex that computes keys
+// using the CRC-64 checksum of a file, which is fast but not cryptographically secure. See the
+// backends package for details.
+package main
+
+import (
+	"github.com/dzhu/go-git-annex-external/backend"
+	"github.com/dzhu/go-git-annex-external/backend/backends"
+)
+
+func main() {
+	backend.Run(backends.CRC64())
+}
@@ -0,0 +1,12 @@
+// Command git-annex-backend-XMULTIHASH is an external backend for git-annex that computes keys
+// using the SHA-256 hash in multihash format of a file. See the backends package for details.
+package main
+
+import (
+	"github.com/dzhu/go-git-annex-external/backend"
+	"github.com/dzhu/go-git-annex-external/backend/backends"
+)
+
+func main() {
+	backend.Run(backends.Multihash())
+}
@@ -0,0 +1,12 @@
+// Command git-annex-backend-XSHA3_256 is an external backend for git-annex that computes keys
+// using the SHA3-256 hash of a file. See the backends package for details.
+package main
+
+import (
+	"github.com/dzhu/go-git-annex-external/backend"
+	"github.com/dzhu/go-git-annex-external/backend/backends"
+)
+
+func main() {
+	backend.Run(backends.SHA3_256())
+}
@@ -0,0 +1,80 @@
+// Command git-annex-backend-XWORM is an external backend for git-annex that works like git-annex's
+// native WORM ("write once, read many") backend: it names keys by the names of files and includes
+// their sizes and modification times, without reading their content. It is meant as a
+// demonstration of backends that are not stable and of backend.HasGenKeyV2; in practice, the native
+// WORM backend should be used instead.
+//
+// Since the name given to the backend is that of the file passed by git-annex, which is not always
+// the file being added, keys may not match those of the native backend.
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/dzhu/go-git-annex-external/backend"
+)
+
+// maxNameLength is the length to which names are limited, as by the native backend: the length of
+// a hex-encoded SHA-256 checksum.
+const maxNameLength = 64
+
+type worm struct{}
+
+// IsStable returns false, since a file's key changes when it is renamed or touched even if its
+// content does not.
+func (worm) IsStable(a backend.Annex) bool {
+	return false
+}
+
+// GenKey is required by backend.BackendV1, but the library calls GenKeyV2 instead.
+func (w worm) GenKey(a backend.Annex, file string) (string, bool, error) {
+	name, fields, err := w.GenKeyV2(a, file)
+	return name, fields.Size, err
+}
+
+// GenKeyV2 names the key by the name of the file and asks for the size and modification time
+// fields.
+func (worm) GenKeyV2(a backend.Annex, file string) (string, backend.KeyFields, error) {
+	return keyName(filepath.Base(file)), backend.KeyFields{Size: true, Mtime: true}, nil
+}
+
+// keyName escapes a file name for use in a key in the same way as git-annex's genKeyName: ASCII
+// letters and digits and the characters ".-_/%:" are kept, "," is doubled, and any other character
+// is replaced by "," followed by its decimal code point. Names that were longer than the limit
+// before escaping are shortened and suffixed with the MD5 checksum of the unescaped name.
+func keyName(file string) string {
+	var b strings.Builder
+	for _, r := range file {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			b.WriteRune(r)
+		case strings.ContainsRune(".-_/%:", r):
+			b.WriteRune(r)
+		case r == ',':
+			b.WriteString(",,")
+		default:
+			fmt.Fprintf(&b, ",%d", r)
+		}
+	}
+	name := b.String()
+	if len(file) > maxNameLength {
+		sum := md5.Sum([]byte(file))
+		suffix := hex.EncodeToString(sum[:])
+		name = name[:maxNameLength-len(suffix)-1] + "-" + suffix
+	}
+	return name
+}
+
+func main() {
+	backend.Run(worm{})
+}
+
+// Statically ensure that the backend satisfies the interfaces used by the library.
+var (
+	_ backend.BackendV1   = worm{}
+	_ backend.HasGenKeyV2 = worm{}
+)
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dzhu/go-git-annex-external/backend/backendtest"
+	"github.com/dzhu/go-git-annex-external/key"
+)
+
+func TestCheck(t *testing.T) {
+	if err := backendtest.Check(worm{}, "WORM"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xworm-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "my file.txt")
+	if err := ioutil.WriteFile(file, []byte("content\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1700000000, 0)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	h := backendtest.Start(worm{}, "WORM")
+	defer h.Close()
+	k, err := h.GenKey(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "XWORM-s8-m1700000000--my,32file.txt"; k != want {
+		t.Errorf("GenKey = %q, want %q", k, want)
+	}
+	parsed, err := key.Parse(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.HasMtime || parsed.Mtime != mtime.Unix() {
+		t.Errorf("key %q does not have the modification time %d", k, mtime.Unix())
+	}
+}
+
+func TestKeyName(t *testing.T) {
+	long := strings.Repeat("a b ", 17)
+	for _, tc := range []struct {
+		file, name string
+	}{
+		{"photo.jpg", "photo.jpg"},
+		{"a b", "a,32b"},
+		{"a,b", "a,,b"},
+		{"100%:x", "100%:x"},
+		{"café", "caf,233"},
+		// Names are shortened by their length before escaping and suffixed with the MD5 checksum of
+		// the unescaped name.
+		{long, "a,32b,32a,32b,32a,32b,32a,32b,3-1069ea06d7f06810aea28e70051b541b"},
+	} {
+		if got := keyName(tc.file); got != tc.name {
+			t.Errorf("keyName(%q) = %q, want %q", tc.file, got, tc.name)
+		}
+	}
+}
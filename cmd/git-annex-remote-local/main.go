@@ -12,8 +12,6 @@ import (
 	"github.com/dzhu/go-git-annex-external/remote"
 )
 
-const rootConfigName = "root"
-
 func copyFile(src, dst string) error {
 	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
 		return err
@@ -34,33 +32,42 @@ func copyFile(src, dst string) error {
 	return nil
 }
 
+type fileConfig struct {
+	Root string `config:"root,required" desc:"the root directory"`
+}
+
 type fileRemote struct {
-	root string
+	fileConfig
 }
 
 func (f *fileRemote) getTempPath(key string) string {
-	return filepath.Join(f.root, "tmp", key)
+	return filepath.Join(f.Root, "tmp", key)
 }
 
 func (f *fileRemote) getPath(key string) string {
-	return filepath.Join(f.root, key)
+	return filepath.Join(f.Root, key)
 }
 
 func (f *fileRemote) getExportPath(name string) string {
-	return filepath.Join(f.root, name)
+	return filepath.Join(f.Root, name)
+}
+
+func (f *fileRemote) config() *remote.Config {
+	return remote.NewConfig(&f.fileConfig)
 }
 
 func (f *fileRemote) Init(a remote.Annex) error {
-	root := a.GetConfig(rootConfigName)
-	if root == "" {
-		return errors.New("must provide root directory")
+	if err := f.config().Load(a); err != nil {
+		return err
 	}
-	return os.MkdirAll(root, 0o700)
+	return os.MkdirAll(f.Root, 0o700)
 }
 
 func (f *fileRemote) Prepare(a remote.Annex) error {
-	f.root = a.GetConfig(rootConfigName)
-	a.Infof("prepared with root %s", f.root)
+	if err := f.config().Load(a); err != nil {
+		return err
+	}
+	a.Infof("prepared with root %s", f.Root)
 	return nil
 }
 
@@ -103,9 +110,7 @@ func (f *fileRemote) Extensions(a remote.Annex, es []string) []string {
 }
 
 func (f *fileRemote) ListConfigs(a remote.Annex) []remote.ConfigSetting {
-	return []remote.ConfigSetting{
-		{Name: "root", Description: "the root directory"},
-	}
+	return f.config().ListConfigs()
 }
 
 func (f *fileRemote) StoreExport(a remote.Annex, name, key, file string) error {
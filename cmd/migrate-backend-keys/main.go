@@ -0,0 +1,112 @@
+// Command migrate-backend-keys computes the keys of files under a new backend, checking first that
+// each file matches its key under the old backend (see backend.Migrator).
+//
+// Usage:
+//
+//	migrate-backend-keys [-j workers] old new < paths
+//
+// The paths of the files are read from standard input, one per line, and a line "<old key> <new
+// key>" is printed for each file that is migrated successfully, in the order of the input. Files
+// that cannot be migrated are reported on standard error, and the command then exits with a
+// nonzero status.
+//
+// The backends are named as they appear in keys. The external backends of the backends package are
+// available with the "X" prefix, such as XSHORTHASH or XBLAKE2B256, as are the native backends
+// MD5, SHA1, SHA256, and SHA512 and their "E" variants.
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"flag"
+	"fmt"
+	"hash"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dzhu/go-git-annex-external/backend"
+	"github.com/dzhu/go-git-annex-external/backend/backends"
+)
+
+func available() map[string]backend.BackendV1 {
+	all := make(map[string]backend.BackendV1)
+	for name, b := range backends.All() {
+		all["X"+name] = b
+	}
+	native := map[string]func() hash.Hash{
+		"MD5":    md5.New,
+		"SHA1":   sha1.New,
+		"SHA256": sha256.New,
+		"SHA512": sha512.New,
+	}
+	for name, h := range native {
+		all[name] = &backend.HashBackend{New: h}
+		all[name+"E"] = &backend.HashBackend{New: h, Extensions: true}
+	}
+	return all
+}
+
+func names(all map[string]backend.BackendV1) string {
+	var names []string
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func main() {
+	workers := flag.Int("j", 0, "the number of files to process at once (default: the number of CPUs)")
+	flag.Parse()
+	if flag.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: migrate-backend-keys [-j workers] old new < paths")
+		os.Exit(2)
+	}
+
+	all := available()
+	m := &backend.Migrator{OldName: flag.Arg(0), NewName: flag.Arg(1), Workers: *workers}
+	var ok bool
+	for _, b := range []struct {
+		name string
+		b    *backend.BackendV1
+	}{{m.OldName, &m.Old}, {m.NewName, &m.New}} {
+		if *b.b, ok = all[b.name]; !ok {
+			fmt.Fprintf(os.Stderr, "unknown backend %q (available: %s)\n", b.name, names(all))
+			os.Exit(2)
+		}
+	}
+
+	var files []string
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		if s.Text() != "" {
+			files = append(files, s.Text())
+		}
+	}
+	if err := s.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	failed := false
+	w := bufio.NewWriter(os.Stdout)
+	for _, mig := range m.MigrateAll(files) {
+		if mig.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", mig.File, mig.Err)
+			failed = true
+			continue
+		}
+		fmt.Fprintln(w, mig.OldKey, mig.NewKey)
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -1,3 +1,8 @@
 module github.com/dzhu/go-git-annex-external
 
 go 1.15
+
+require (
+	github.com/klauspost/compress v1.15.1
+	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
+)
@@ -0,0 +1,220 @@
+// Package key parses and constructs git-annex keys, the names git-annex gives to pieces of content.
+//
+// A key has the form
+//
+//	BACKEND[-sSIZE][-mMTIME][-SCHUNKSIZE-CCHUNKNUMBER]--NAME
+//
+// where BACKEND names the backend that generated the key, SIZE is the size of the content in bytes,
+// MTIME is the modification time of the file the key was generated from in seconds since the Unix
+// epoch, CHUNKSIZE and CHUNKNUMBER identify one chunk of content split into chunks of CHUNKSIZE
+// bytes (numbered from 1), and NAME is generated by the backend, such as a hash of the content.
+// Only BACKEND and NAME are required.
+//
+// See https://git-annex.branchable.com/internals/key_format/ for further information.
+package key
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Key is a parsed git-annex key.
+type Key struct {
+	// Backend is the name of the backend that generated the key, such as "SHA256E" or, for external
+	// backends, "XNAME".
+	Backend string
+	// Size is the size of the content in bytes; it is present in the key only if HasSize is true.
+	Size    int64
+	HasSize bool
+	// Mtime is the modification time of the file the key was generated from, in seconds since the
+	// Unix epoch; it is present in the key only if HasMtime is true.
+	Mtime    int64
+	HasMtime bool
+	// ChunkSize and ChunkNum identify a chunk of the content; they are present in the key only if
+	// ChunkSize is positive.
+	ChunkSize int64
+	ChunkNum  int
+	// Name is the name generated by the backend, not including Extension.
+	Name string
+	// Extension is the file extension, including the leading dot, that backends whose names end in
+	// "E" (such as SHA256E) append to Name. It is empty for other backends.
+	Extension string
+}
+
+// ParseError is returned by Parse for malformed keys.
+type ParseError struct {
+	Key string
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("invalid key %q: %v", e.Key, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Parse parses a key.
+func Parse(s string) (Key, error) {
+	k, err := parse(s)
+	if err != nil {
+		return Key{}, &ParseError{Key: s, Err: err}
+	}
+	return k, nil
+}
+
+func parse(s string) (Key, error) {
+	var k Key
+	i := strings.Index(s, "--")
+	if i < 0 {
+		return k, errors.New("missing \"--\" before the name")
+	}
+	fields := strings.Split(s[:i], "-")
+	k.Backend = fields[0]
+	hasChunkNum := false
+	for _, f := range fields[1:] {
+		// ParseInt accepts a sign, which git-annex does not write.
+		if len(f) < 2 || f[1] < '0' || f[1] > '9' {
+			return k, fmt.Errorf("malformed field %q", f)
+		}
+		n, err := strconv.ParseInt(f[1:], 10, 64)
+		if err != nil {
+			return k, fmt.Errorf("malformed field %q", f)
+		}
+		switch f[0] {
+		case 's':
+			k.Size, k.HasSize = n, true
+		case 'm':
+			k.Mtime, k.HasMtime = n, true
+		case 'S':
+			k.ChunkSize = n
+		case 'C':
+			if n > int64(int(^uint(0)>>1)) {
+				return k, fmt.Errorf("malformed field %q", f)
+			}
+			k.ChunkNum, hasChunkNum = int(n), true
+		default:
+			return k, fmt.Errorf("unknown field %q", f)
+		}
+	}
+	if (k.ChunkSize != 0) != hasChunkNum {
+		return k, errors.New("chunk size and chunk number must appear together")
+	}
+	k.Name = s[i+2:]
+	if strings.HasSuffix(k.Backend, "E") {
+		if j := strings.IndexByte(k.Name, '.'); j >= 0 {
+			k.Name, k.Extension = k.Name[:j], k.Name[j:]
+		}
+	}
+	return k, k.validate()
+}
+
+// Validate checks that the key is well-formed, so that git-annex can parse its String form.
+func (k Key) Validate() error {
+	if err := k.validate(); err != nil {
+		return &ParseError{Key: k.String(), Err: err}
+	}
+	return nil
+}
+
+func (k Key) validate() error {
+	switch {
+	case k.Backend == "":
+		return errors.New("empty backend name")
+	case strings.ContainsAny(k.Backend, "- \t\n\r\x00"):
+		return fmt.Errorf("invalid backend name %q", k.Backend)
+	case k.Name == "":
+		return errors.New("empty name")
+	case strings.ContainsAny(k.Name+k.Extension, "\n\r\x00"):
+		return errors.New("name contains a newline or NUL character")
+	case k.HasSize && k.Size < 0:
+		return errors.New("negative size")
+	case k.ChunkSize < 0:
+		return errors.New("negative chunk size")
+	case k.ChunkSize > 0 && k.ChunkNum < 1:
+		return errors.New("chunk number must be at least 1")
+	case k.Extension != "" && !strings.HasPrefix(k.Extension, "."):
+		return errors.New("extension must begin with a dot")
+	case k.Extension != "" && !strings.HasSuffix(k.Backend, "E"):
+		return fmt.Errorf("backend %s does not use extensions", k.Backend)
+	}
+	return nil
+}
+
+// String returns the key in git-annex's format.
+func (k Key) String() string {
+	var b strings.Builder
+	b.WriteString(k.Backend)
+	if k.HasSize {
+		fmt.Fprintf(&b, "-s%d", k.Size)
+	}
+	if k.HasMtime {
+		fmt.Fprintf(&b, "-m%d", k.Mtime)
+	}
+	if k.IsChunk() {
+		fmt.Fprintf(&b, "-S%d-C%d", k.ChunkSize, k.ChunkNum)
+	}
+	b.WriteString("--")
+	b.WriteString(k.Name)
+	b.WriteString(k.Extension)
+	return b.String()
+}
+
+// IsChunk reports whether the key identifies a chunk of content.
+func (k Key) IsChunk() bool {
+	return k.ChunkSize > 0
+}
+
+// Chunk returns the key of the nth chunk (numbered from 1) of the content of k, split into chunks
+// of the given size.
+func (k Key) Chunk(size int64, n int) Key {
+	k.ChunkSize, k.ChunkNum = size, n
+	return k
+}
+
+// NonChunk returns the key of the whole content of which k is a chunk, or k itself if it is not a
+// chunk key.
+func (k Key) NonChunk() Key {
+	k.ChunkSize, k.ChunkNum = 0, 0
+	return k
+}
+
+// HashDirLower returns the two-level directory, such as "f87/4d5/", that git-annex uses to store
+// the key in bare repositories and that special remotes conventionally use to spread keys across
+// directories. It is the value returned by git-annex for the DIRHASH-LOWER request.
+func (k Key) HashDirLower() string {
+	return HashDirLower(k.NonChunk().String())
+}
+
+// HashDirMixed returns the two-level directory, such as "pX/ZJ/", that git-annex uses to store the
+// key in non-bare repositories. It is the value returned by git-annex for the DIRHASH request.
+func (k Key) HashDirMixed() string {
+	return HashDirMixed(k.NonChunk().String())
+}
+
+// HashDirLower returns the lowercase hash directory of a serialized key, hashing it exactly as
+// given. Unlike the method of the same name, it does not remove chunk fields.
+func HashDirLower(s string) string {
+	sum := md5.Sum([]byte(s))
+	h := hex.EncodeToString(sum[:])
+	return h[:3] + "/" + h[3:6] + "/"
+}
+
+// HashDirMixed returns the mixed-case hash directory of a serialized key, hashing it exactly as
+// given. Unlike the method of the same name, it does not remove chunk fields.
+func HashDirMixed(s string) string {
+	sum := md5.Sum([]byte(s))
+	w := uint32(sum[0]) | uint32(sum[1])<<8 | uint32(sum[2])<<16 | uint32(sum[3])<<24
+	const chars = "0123456789zqjxkmvwgpfZQJXKMVWGPF"
+	var cs [8]byte
+	for i := range cs {
+		cs[i] = chars[(w>>(6*uint(i)))&31]
+	}
+	// git-annex swaps adjacent pairs of characters and uses the first four.
+	return string([]byte{cs[1], cs[0]}) + "/" + string([]byte{cs[3], cs[2]}) + "/"
+}
@@ -0,0 +1,109 @@
+package key
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		s   string
+		key Key
+	}{
+		{"WORM--foo", Key{Backend: "WORM", Name: "foo"}},
+		{"SHA256-s1024--abc", Key{Backend: "SHA256", Size: 1024, HasSize: true, Name: "abc"}},
+		{"SHA256-s0--abc", Key{Backend: "SHA256", HasSize: true, Name: "abc"}},
+		{"WORM-s8-m1700000000--my,32file.txt", Key{Backend: "WORM", Size: 8, HasSize: true, Mtime: 1700000000, HasMtime: true, Name: "my,32file.txt"}},
+		{"WORM-m0--x", Key{Backend: "WORM", HasMtime: true, Name: "x"}},
+		{"SHA256-s100-S10-C3--abc", Key{Backend: "SHA256", Size: 100, HasSize: true, ChunkSize: 10, ChunkNum: 3, Name: "abc"}},
+		{"SHA256E-s5--abc.tar.gz", Key{Backend: "SHA256E", Size: 5, HasSize: true, Name: "abc", Extension: ".tar.gz"}},
+		{"SHA256E--abc", Key{Backend: "SHA256E", Name: "abc"}},
+		{"SHA256E-S10-C1--abc.txt", Key{Backend: "SHA256E", ChunkSize: 10, ChunkNum: 1, Name: "abc", Extension: ".txt"}},
+		// Only backends ending in E split off extensions.
+		{"SHA256--abc.txt", Key{Backend: "SHA256", Name: "abc.txt"}},
+		{"XCDC--a-b--c", Key{Backend: "XCDC", Name: "a-b--c"}},
+	} {
+		k, err := Parse(tc.s)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tc.s, err)
+			continue
+		}
+		if k != tc.key {
+			t.Errorf("Parse(%q) = %+v, want %+v", tc.s, k, tc.key)
+		}
+		if got := k.String(); got != tc.s {
+			t.Errorf("Parse(%q).String() = %q", tc.s, got)
+		}
+		if err := k.Validate(); err != nil {
+			t.Errorf("Parse(%q).Validate(): %v", tc.s, err)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"WORM",
+		"WORM-foo",
+		"--foo",
+		"WORM--",
+		"WORM-s--foo",
+		"WORM-sx--foo",
+		"WORM-s12x--foo",
+		"WORM-s+5--foo",
+		"WORM-s-5--foo",
+		"WORM-m-5--foo",
+		"WORM-s99999999999999999999--foo",
+		"WORM-x5--foo",
+		"WORM-S10--foo",
+		"WORM-C1--foo",
+		"WORM-S0-C1--foo",
+		"WORM-S10-C0--foo",
+		"WORM-S-10-C1--foo",
+		"WORM--foo\nbar",
+		"WORM--foo\x00",
+	} {
+		_, err := Parse(s)
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			t.Errorf("Parse(%q) = %v, want a *ParseError", s, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, k := range []Key{
+		{Name: "foo"},
+		{Backend: "WORM"},
+		{Backend: "A-B", Name: "foo"},
+		{Backend: "WORM", Size: -1, HasSize: true, Name: "foo"},
+		{Backend: "WORM", ChunkSize: -1, ChunkNum: 1, Name: "foo"},
+		{Backend: "WORM", ChunkSize: 10, Name: "foo"},
+		{Backend: "SHA256E", Name: "foo", Extension: "txt"},
+		{Backend: "SHA256", Name: "foo", Extension: ".txt"},
+	} {
+		if err := k.Validate(); err == nil {
+			t.Errorf("%+v.Validate() succeeded", k)
+		}
+	}
+}
+
+func TestChunk(t *testing.T) {
+	k, err := Parse("SHA256E-s100--abc.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := k.Chunk(10, 2)
+	if got, want := c.String(), "SHA256E-s100-S10-C2--abc.txt"; got != want {
+		t.Errorf("Chunk = %q, want %q", got, want)
+	}
+	if !c.IsChunk() || k.IsChunk() {
+		t.Errorf("IsChunk = %v for the chunk and %v for the key", c.IsChunk(), k.IsChunk())
+	}
+	if c.NonChunk() != k {
+		t.Errorf("NonChunk = %+v, want %+v", c.NonChunk(), k)
+	}
+	if c.HashDirLower() != k.HashDirLower() || c.HashDirMixed() != k.HashDirMixed() {
+		t.Error("a chunk hashes to a different directory than its key")
+	}
+}
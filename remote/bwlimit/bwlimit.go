@@ -0,0 +1,165 @@
+// Package bwlimit provides a wrapper for external special remotes that limits the bandwidth used
+// by transfers. All transfers through the wrapper, including those running concurrently in
+// separate async jobs, share a single limit.
+//
+// The limit is set with the "bwlimit" config setting (for example, bwlimit=2MiB for two mebibytes
+// per second) or, to vary it by time of day, with the "bwschedule" setting (see ParseSchedule);
+// the schedule takes precedence if both are set.
+//
+// The wrapper throttles a transfer as the wrapped remote reports its progress, by delaying its
+// calls to Annex.Progress until the limiter allows the bytes reported, so it is only as precise as
+// those reports are frequent. Bytes of a transfer that the wrapped remote did not report are
+// charged once the transfer completes; this does not slow down that transfer, but it delays its
+// completion and the transfers that follow it, so that a remote reporting no progress at all is
+// still held to the limit over a series of transfers.
+package bwlimit
+
+import (
+	"os"
+	"sync"
+
+	"github.com/dzhu/go-git-annex-external/remote"
+)
+
+// Config is the configuration read by the wrapper.
+type Config struct {
+	Limit    remote.Size `config:"bwlimit" desc:"maximum transfer rate in bytes per second, such as 2MiB (0 for no limit)"`
+	Schedule string      `config:"bwschedule" desc:"time-of-day rates, such as \"08:00,512KiB 18:00,off\""`
+}
+
+// Validate checks that the schedule, if any, is well-formed.
+func (c *Config) Validate() error {
+	_, err := ParseSchedule(c.Schedule)
+	return err
+}
+
+func (c *Config) limiter() *Limiter {
+	if sched, _ := ParseSchedule(c.Schedule); len(sched) > 0 {
+		return NewScheduledLimiter(sched)
+	}
+	return NewLimiter(int64(c.Limit))
+}
+
+// Remote wraps a remote to limit the bandwidth of its transfers.
+type Remote struct {
+	remote.RemoteV1
+	Config
+
+	mu      sync.Mutex
+	limiter *Limiter
+}
+
+// Wrap returns a remote that limits the bandwidth used by transfers of r.
+func Wrap(r remote.RemoteV1) *Remote {
+	return &Remote{RemoteV1: r, limiter: NewLimiter(0)}
+}
+
+// Unwrap returns the wrapped remote.
+func (r *Remote) Unwrap() remote.RemoteV1 {
+	return r.RemoteV1
+}
+
+// ListConfigs returns the settings of the wrapper followed by those of the wrapped remote.
+func (r *Remote) ListConfigs(a remote.Annex) []remote.ConfigSetting {
+	configs := remote.NewConfig(&Config{}).ListConfigs()
+	var h remote.HasListConfigs
+	if remote.As(r.RemoteV1, &h) {
+		configs = append(configs, h.ListConfigs(a)...)
+	}
+	return configs
+}
+
+// Init validates the settings and initializes the wrapped remote.
+func (r *Remote) Init(a remote.Annex) error {
+	var c Config
+	if err := remote.NewConfig(&c).Load(a); err != nil {
+		return err
+	}
+	return r.RemoteV1.Init(a)
+}
+
+// Prepare loads the settings and prepares the wrapped remote.
+func (r *Remote) Prepare(a remote.Annex) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := remote.NewConfig(&r.Config).Load(a); err != nil {
+		return err
+	}
+	r.limiter = r.Config.limiter()
+	return r.RemoteV1.Prepare(a)
+}
+
+func (r *Remote) transferAnnex(a remote.Annex) *transferAnnex {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &transferAnnex{Annex: a, l: r.limiter}
+}
+
+// Store stores the file with the wrapped remote, throttling it through its progress reports.
+func (r *Remote) Store(a remote.Annex, key, file string) error {
+	t := r.transferAnnex(a)
+	if err := r.RemoteV1.Store(t, key, file); err != nil {
+		return err
+	}
+	return t.finish(file)
+}
+
+// Retrieve retrieves the key with the wrapped remote, throttling it through its progress reports.
+func (r *Remote) Retrieve(a remote.Annex, key, file string) error {
+	t := r.transferAnnex(a)
+	if err := r.RemoteV1.Retrieve(t, key, file); err != nil {
+		return err
+	}
+	return t.finish(file)
+}
+
+// transferAnnex is passed to the wrapped remote for one transfer. It tracks how many bytes of the
+// transfer have been charged to the limiter, so that no byte is charged twice.
+type transferAnnex struct {
+	remote.Annex
+	l *Limiter
+
+	mu      sync.Mutex
+	charged int64
+}
+
+// charge waits for the limiter to allow the transfer to reach the given number of bytes, at most
+// maxWait bytes at a time so that a large jump in progress does not hold up other jobs for too
+// long.
+func (t *transferAnnex) charge(total int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.charged < total {
+		n := total - t.charged
+		if n > maxWait {
+			n = maxWait
+		}
+		t.l.Wait(int(n))
+		t.charged += n
+	}
+}
+
+// Progress waits until the limiter allows the bytes reported before passing on the report, which
+// holds up the wrapped remote's transfer.
+func (t *transferAnnex) Progress(bytes int) {
+	t.charge(int64(bytes))
+	t.Annex.Progress(bytes)
+}
+
+// finish charges the bytes of the transferred file that the wrapped remote did not report as
+// progress.
+func (t *transferAnnex) finish(file string) error {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	t.charge(fi.Size())
+	return nil
+}
+
+// Statically ensure that the wrapper satisfies the interfaces used by the library.
+var (
+	_ remote.RemoteV1       = (*Remote)(nil)
+	_ remote.Unwrapper      = (*Remote)(nil)
+	_ remote.HasListConfigs = (*Remote)(nil)
+)
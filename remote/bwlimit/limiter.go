@@ -0,0 +1,175 @@
+package bwlimit
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dzhu/go-git-annex-external/remote"
+)
+
+// Limiter is a token bucket limiting the rate at which bytes flow. It is safe for concurrent use;
+// concurrent callers share the rate.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   func(time.Time) int64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter allowing the given number of bytes per second. A rate of zero or
+// less means no limit.
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: func(time.Time) int64 { return rate }}
+}
+
+// NewScheduledLimiter returns a limiter whose rate follows the given schedule.
+func NewScheduledLimiter(s Schedule) *Limiter {
+	return &Limiter{rate: s.Rate}
+}
+
+// Wait blocks until n bytes may pass.
+func (l *Limiter) Wait(n int) {
+	if n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	rate := float64(l.rate(now))
+	if rate <= 0 {
+		l.tokens = 0
+		l.last = now
+		l.mu.Unlock()
+		return
+	}
+	// Allow bursts of up to a quarter of a second's worth of data.
+	burst := rate / 4
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+	}
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	// Reserve the tokens immediately, going into debt if necessary, so that concurrent callers are
+	// served in order and the combined rate stays within the limit.
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// maxWait is the largest amount passed to Wait at once by the readers, writers and transfers, so
+// that a large read or write does not hold up other jobs for too long.
+const maxWait = 32 << 10
+
+type reader struct {
+	l *Limiter
+	r io.Reader
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > maxWait {
+		p = p[:maxWait]
+	}
+	n, err := r.r.Read(p)
+	r.l.Wait(n)
+	return n, err
+}
+
+// Reader returns a reader that reads from r at no more than the limiter's rate.
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	return &reader{l, r}
+}
+
+type writer struct {
+	l *Limiter
+	w io.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxWait {
+			chunk = chunk[:maxWait]
+		}
+		w.l.Wait(len(chunk))
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Writer returns a writer that writes to w at no more than the limiter's rate.
+func (l *Limiter) Writer(w io.Writer) io.Writer {
+	return &writer{l, w}
+}
+
+// Schedule is a sequence of rate changes at times of day. Each entry's rate applies from its time
+// until the time of the next entry, and the last entry's rate applies until the first entry's time
+// on the following day.
+type Schedule []ScheduleEntry
+
+// ScheduleEntry is one rate change in a Schedule.
+type ScheduleEntry struct {
+	// Minute is the time of day at which the rate takes effect, in minutes after midnight (local
+	// time).
+	Minute int
+	// Rate is the number of bytes per second allowed; zero or less means no limit.
+	Rate int64
+}
+
+// ParseSchedule parses a schedule written as space-separated "HH:MM,rate" entries, where each rate
+// is a size as accepted by remote.ParseSize or "off" for no limit, for example
+// "08:00,512KiB 18:00,4MiB 23:00,off".
+func ParseSchedule(s string) (Schedule, error) {
+	var sched Schedule
+	for _, field := range strings.Fields(s) {
+		parts := strings.SplitN(field, ",", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("schedule entry %q is not of the form HH:MM,rate", field)
+		}
+		var h, m int
+		if _, err := fmt.Sscanf(parts[0], "%d:%d", &h, &m); err != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+			return nil, fmt.Errorf("invalid time %q in schedule", parts[0])
+		}
+		var rate int64
+		if parts[1] != "off" {
+			size, err := remote.ParseSize(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid rate in schedule: %w", err)
+			}
+			rate = int64(size)
+		}
+		sched = append(sched, ScheduleEntry{Minute: h*60 + m, Rate: rate})
+	}
+	sort.SliceStable(sched, func(i, j int) bool { return sched[i].Minute < sched[j].Minute })
+	return sched, nil
+}
+
+// Rate returns the rate in effect at the given time.
+func (s Schedule) Rate(t time.Time) int64 {
+	if len(s) == 0 {
+		return 0
+	}
+	minute := t.Hour()*60 + t.Minute()
+	rate := s[len(s)-1].Rate
+	for _, e := range s {
+		if e.Minute > minute {
+			break
+		}
+		rate = e.Rate
+	}
+	return rate
+}
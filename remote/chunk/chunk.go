@@ -0,0 +1,345 @@
+// Package chunk provides a wrapper for external special remotes that splits content into
+// fixed-size chunks, in the manner of the chunk= setting of git-annex's built-in special remotes.
+// Each chunk is stored in the wrapped remote under its own key, named as git-annex names chunk
+// keys: the original key with "-S<chunk size>-C<chunk number>" fields added.
+//
+// The chunk size is taken from the "wrapchunk" config setting (for example, wrapchunk=100MiB). It
+// is deliberately not named "chunk": git-annex handles chunk= itself for every external special
+// remote, so content would be chunked twice. Do not set both. The number of chunks and the chunk
+// size used for each key are recorded in the remote's state, so content remains retrievable after
+// the setting is changed. Keys stored without chunking, including those stored before chunking was
+// enabled, are passed through to the wrapped remote unchanged.
+//
+// When a key is stored again with a different chunk size, the objects of its earlier layout are
+// removed from the wrapped remote once the new layout is stored: the chunks of an earlier chunked
+// store, or the whole object of an earlier store without chunking (or with chunking disabled). If
+// that removal fails, the leftover objects are reported in a debug message and stay in the remote.
+package chunk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dzhu/go-git-annex-external/key"
+	"github.com/dzhu/go-git-annex-external/remote"
+)
+
+// Config is the configuration read by the wrapper.
+type Config struct {
+	ChunkSize remote.Size `config:"wrapchunk" desc:"size of chunks to split content into, such as 100MiB (0 disables chunking)"`
+}
+
+// Remote wraps a remote to store content in chunks.
+type Remote struct {
+	remote.RemoteV1
+	Config
+
+	tmpDir string
+}
+
+// info is the state recorded for each chunked key.
+type info struct {
+	ChunkSize int64 `json:"s"`
+	Count     int   `json:"n"`
+}
+
+var state = &remote.State{Name: "chunk", Version: 1}
+
+// Wrap returns a remote that stores content in r in chunks.
+func Wrap(r remote.RemoteV1) *Remote {
+	return &Remote{RemoteV1: r}
+}
+
+// Unwrap returns the wrapped remote.
+func (r *Remote) Unwrap() remote.RemoteV1 {
+	return r.RemoteV1
+}
+
+// ListConfigs returns the chunk setting followed by the settings of the wrapped remote.
+func (r *Remote) ListConfigs(a remote.Annex) []remote.ConfigSetting {
+	configs := remote.NewConfig(&Config{}).ListConfigs()
+	var h remote.HasListConfigs
+	if remote.As(r.RemoteV1, &h) {
+		configs = append(configs, h.ListConfigs(a)...)
+	}
+	return configs
+}
+
+// Init validates the chunk setting and initializes the wrapped remote.
+func (r *Remote) Init(a remote.Annex) error {
+	if err := remote.NewConfig(&r.Config).Load(a); err != nil {
+		return err
+	}
+	return r.RemoteV1.Init(a)
+}
+
+// Prepare loads the chunk setting and prepares the wrapped remote.
+func (r *Remote) Prepare(a remote.Annex) error {
+	if err := remote.NewConfig(&r.Config).Load(a); err != nil {
+		return err
+	}
+	r.tmpDir = filepath.Join(a.GetGitDir(), "annex", "tmp")
+	return r.RemoteV1.Prepare(a)
+}
+
+// Key returns the key under which the given chunk (numbered from 1) of the given key is stored.
+func Key(k string, chunkSize int64, n int) string {
+	parsed, err := key.Parse(k)
+	if err != nil {
+		// Keys from git-annex always parse, but keep the chunks of anything else distinct too.
+		return fmt.Sprintf("%s-S%d-C%d", k, chunkSize, n)
+	}
+	return parsed.Chunk(chunkSize, n).String()
+}
+
+func (r *Remote) chunkFile() (string, error) {
+	if err := os.MkdirAll(r.tmpDir, 0o700); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(r.tmpDir, "chunk-")
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// Store splits the file into chunks and stores each one with the wrapped remote. Chunks that the
+// wrapped remote already has, left over from an interrupted earlier attempt, are not stored again.
+func (r *Remote) Store(a remote.Annex, key, file string) error {
+	size := int64(r.ChunkSize)
+	old, chunked, _ := r.info(a, key)
+	if size <= 0 {
+		if err := r.RemoteV1.Store(a, key, file); err != nil {
+			return err
+		}
+		// Make sure that later operations do not look for chunks from an earlier chunked store, and
+		// do not leave those chunks behind.
+		if chunked {
+			state.Clear(a, key)
+			r.removeStale(a, key, old, info{})
+		}
+		return nil
+	}
+
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	count := int((stat.Size() + size - 1) / size)
+	if count == 0 {
+		count = 1
+	}
+
+	tmp, err := r.chunkFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	for n := 1; n <= count; n++ {
+		offset := int64(n-1) * size
+		ck := Key(key, size, n)
+		if present, err := r.RemoteV1.Present(a, ck); err == nil && present {
+			a.Debugf("chunk %d/%d of %s already present", n, count, key)
+			continue
+		}
+		if err := writeChunk(tmp, io.NewSectionReader(in, offset, size)); err != nil {
+			return err
+		}
+		if err := r.RemoteV1.Store(&progressAnnex{a, offset}, ck, tmp); err != nil {
+			return fmt.Errorf("storing chunk %d/%d: %w", n, count, err)
+		}
+		end := offset + size
+		if end > stat.Size() {
+			end = stat.Size()
+		}
+		a.Progress(int(end))
+	}
+
+	i := info{ChunkSize: size, Count: count}
+	if err := state.Set(a, key, i); err != nil {
+		return err
+	}
+	if chunked {
+		r.removeStale(a, key, old, i)
+	} else {
+		r.removeWhole(a, key)
+	}
+	return nil
+}
+
+// removeWhole removes the object of the key stored without chunking, if the wrapped remote has
+// one. Failures are only reported, since the key has been stored successfully.
+func (r *Remote) removeWhole(a remote.Annex, key string) {
+	present, err := r.RemoteV1.Present(a, key)
+	if err != nil || !present {
+		return
+	}
+	if err := r.RemoteV1.Remove(a, key); err != nil {
+		a.Debugf("leaving unchunked object of %s: %v", key, err)
+	}
+}
+
+// removeStale removes the chunks of the previous layout of the key that are not part of the
+// current one. Failures are only reported, since the key has been stored successfully.
+func (r *Remote) removeStale(a remote.Annex, key string, prev, cur info) {
+	for n := 1; n <= prev.Count; n++ {
+		if prev.ChunkSize == cur.ChunkSize && n <= cur.Count {
+			continue
+		}
+		ck := Key(key, prev.ChunkSize, n)
+		if err := r.RemoteV1.Remove(a, ck); err != nil {
+			a.Debugf("leaving stale chunk %s: %v", ck, err)
+		}
+	}
+}
+
+func writeChunk(path string, r io.Reader) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (r *Remote) info(a remote.Annex, key string) (info, bool, error) {
+	var i info
+	ok, err := state.Get(a, key, &i)
+	return i, ok && i.Count > 0, err
+}
+
+// Retrieve fetches each chunk of the key from the wrapped remote and reassembles them into the
+// file. If the file already holds some complete chunks from an interrupted earlier attempt, those
+// chunks are not fetched again.
+func (r *Remote) Retrieve(a remote.Annex, key, file string) error {
+	i, chunked, err := r.info(a, key)
+	if err != nil {
+		return err
+	}
+	if !chunked {
+		return r.RemoteV1.Retrieve(a, key, file)
+	}
+
+	out, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	stat, err := out.Stat()
+	if err != nil {
+		return err
+	}
+	done := int(stat.Size() / i.ChunkSize)
+	if done > i.Count {
+		done = 0
+	}
+	if done > 0 {
+		a.Debugf("resuming retrieval of %s after %d/%d chunks", key, done, i.Count)
+	}
+	offset := int64(done) * i.ChunkSize
+	if err := out.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmp, err := r.chunkFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	for n := done + 1; n <= i.Count; n++ {
+		if err := r.RemoteV1.Retrieve(&progressAnnex{a, offset}, Key(key, i.ChunkSize, n), tmp); err != nil {
+			return fmt.Errorf("retrieving chunk %d/%d: %w", n, i.Count, err)
+		}
+		in, err := os.Open(tmp)
+		if err != nil {
+			return err
+		}
+		written, err := io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+		if n < i.Count && written != i.ChunkSize {
+			return fmt.Errorf("chunk %d/%d has size %d rather than %d", n, i.Count, written, i.ChunkSize)
+		}
+		offset += written
+		a.Progress(int(offset))
+	}
+	return nil
+}
+
+// Present checks that every chunk of the key is present in the wrapped remote.
+func (r *Remote) Present(a remote.Annex, key string) (bool, error) {
+	i, chunked, err := r.info(a, key)
+	if err != nil {
+		return false, err
+	}
+	if !chunked {
+		return r.RemoteV1.Present(a, key)
+	}
+	for n := 1; n <= i.Count; n++ {
+		present, err := r.RemoteV1.Present(a, Key(key, i.ChunkSize, n))
+		if err != nil || !present {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Remove removes every chunk of the key from the wrapped remote.
+func (r *Remote) Remove(a remote.Annex, key string) error {
+	i, chunked, err := r.info(a, key)
+	if err != nil {
+		return err
+	}
+	if !chunked {
+		return r.RemoteV1.Remove(a, key)
+	}
+	var errs []string
+	for n := 1; n <= i.Count; n++ {
+		if err := r.RemoteV1.Remove(a, Key(key, i.ChunkSize, n)); err != nil {
+			errs = append(errs, fmt.Sprintf("chunk %d: %v", n, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	state.Clear(a, key)
+	return nil
+}
+
+// progressAnnex offsets the progress reported by the wrapped remote for one chunk by the amount of
+// data in the preceding chunks.
+type progressAnnex struct {
+	remote.Annex
+	offset int64
+}
+
+func (p *progressAnnex) Progress(bytes int) {
+	p.Annex.Progress(int(p.offset) + bytes)
+}
+
+// Statically ensure that the wrapper satisfies the interfaces used by the library.
+var (
+	_ remote.RemoteV1       = (*Remote)(nil)
+	_ remote.Unwrapper      = (*Remote)(nil)
+	_ remote.HasListConfigs = (*Remote)(nil)
+)
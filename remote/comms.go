@@ -11,6 +11,7 @@ import (
 type annexIO struct {
 	io         internal.LineIO
 	impl       RemoteV1
+	mode       *modeState
 	exportName string
 }
 
@@ -73,7 +74,11 @@ func (a *annexIO) GetCreds(setting string) (string, string) {
 	resp := a.io.Recv()
 	sp := strings.SplitN(resp, " ", 3)
 	if sp[0] != "CREDS" {
-		panic(fmt.Sprintf("got %s rather than CREDS in response", sp[0]))
+		a.Debugf("got %s rather than CREDS in response", sp[0])
+		return "", ""
+	}
+	for len(sp) < 3 {
+		sp = append(sp, "")
 	}
 	return sp[1], sp[2]
 }
@@ -0,0 +1,134 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// Codec is a compression format usable by the wrapper.
+type Codec interface {
+	// NewWriter returns a writer that compresses data written to it into w. The level is the value
+	// of the compressionlevel setting, or 0 to use the codec's default.
+	NewWriter(w io.Writer, level int) (io.WriteCloser, error)
+	// NewReader returns a reader that decompresses data read from r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+type codecEntry struct {
+	id    byte
+	name  string
+	codec Codec
+}
+
+var (
+	codecsByID   = map[byte]codecEntry{}
+	codecsByName = map[string]codecEntry{}
+)
+
+// Register makes a codec available under the given name, for use in the compression setting, and
+// ID, which is recorded in the header of each stored object. IDs must never be reused for a
+// different format, since objects stored with them would become unreadable. Register panics if the
+// name or ID is already taken.
+func Register(id byte, name string, c Codec) {
+	if _, ok := codecsByID[id]; ok {
+		panic(fmt.Sprintf("compress: codec ID %d registered twice", id))
+	}
+	if _, ok := codecsByName[name]; ok {
+		panic(fmt.Sprintf("compress: codec %q registered twice", name))
+	}
+	e := codecEntry{id, name, c}
+	codecsByID[id] = e
+	codecsByName[name] = e
+}
+
+func codecNames() string {
+	var names []string
+	for name := range codecsByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Codec IDs used by the codecs provided by this package.
+const (
+	IDNone byte = 0
+	IDGzip byte = 1
+	IDZstd byte = 2
+)
+
+type noneCodec struct{}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (noneCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func init() {
+	Register(IDNone, "none", noneCodec{})
+	Register(IDGzip, "gzip", gzipCodec{})
+}
+
+// compressedSignatures are prefixes of common file formats whose content is already compressed,
+// so that compressing it again would waste time for little or no gain.
+var compressedSignatures = []struct {
+	offset int
+	sig    string
+}{
+	{0, "\x1f\x8b"},             // gzip
+	{0, "\x28\xb5\x2f\xfd"},     // zstd
+	{0, "\xfd7zXZ\x00"},         // xz
+	{0, "BZh"},                  // bzip2
+	{0, "\x04\x22\x4d\x18"},     // lz4
+	{0, "PK\x03\x04"},           // zip and derived formats
+	{0, "7z\xbc\xaf\x27\x1c"},   // 7-zip
+	{0, "Rar!\x1a\x07"},         // rar
+	{0, "\xff\xd8\xff"},         // jpeg
+	{0, "\x89PNG\r\n\x1a\n"},    // png
+	{0, "GIF8"},                 // gif
+	{8, "WEBP"},                 // webp
+	{4, "ftyp"},                 // mp4, mov, heic
+	{0, "\x1a\x45\xdf\xa3"},     // matroska, webm
+	{0, "OggS"},                 // ogg
+	{0, "fLaC"},                 // flac
+	{0, "ID3"},                  // mp3
+	{0, "%PDF"},                 // pdf (streams are usually compressed)
+	{0, "\x00\x00\x00\x0cjP  "}, // jpeg 2000
+}
+
+// sniffCompressed reports whether the given prefix of a file looks like an already-compressed
+// format.
+func sniffCompressed(prefix []byte) bool {
+	for _, s := range compressedSignatures {
+		if len(prefix) >= s.offset+len(s.sig) &&
+			bytes.Equal(prefix[s.offset:s.offset+len(s.sig)], []byte(s.sig)) {
+			return true
+		}
+	}
+	return false
+}
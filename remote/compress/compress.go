@@ -0,0 +1,264 @@
+// Package compress provides a wrapper for external special remotes that compresses content before
+// storing it and decompresses it when retrieving it.
+//
+// The codec is chosen with the "compression" config setting; gzip is always available, and zstd is
+// available when the package is built with the "zstd" build tag (which requires the
+// github.com/klauspost/compress module). Other codecs may be added with Register. Each stored
+// object begins with a small header identifying the codec it was written with, so changing the
+// setting does not affect objects that are already stored, and objects stored before the wrapper
+// was introduced (which have no header) are retrieved unchanged.
+//
+// Content that already appears to be compressed, judging by its first bytes, is stored without
+// compression.
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dzhu/go-git-annex-external/remote"
+)
+
+// magic begins the header of every object stored by the wrapper; it is followed by one byte
+// holding the ID of the codec.
+const magic = "\x00GAXZ\x01"
+
+// sniffLen is the number of bytes examined to detect already-compressed content.
+const sniffLen = 16
+
+// Config is the configuration read by the wrapper.
+type Config struct {
+	Codec string `config:"compression" default:"gzip" desc:"compression codec for newly stored content"`
+	Level int    `config:"compressionlevel" desc:"codec-specific compression level (0 for the default)"`
+}
+
+// Validate checks that the configured codec is available.
+func (c *Config) Validate() error {
+	if _, ok := codecsByName[c.Codec]; !ok {
+		return fmt.Errorf("compression codec %q is not available (available: %s)", c.Codec, codecNames())
+	}
+	return nil
+}
+
+// Remote wraps a remote to compress its content.
+type Remote struct {
+	remote.RemoteV1
+	Config
+
+	tmpDir string
+}
+
+// Wrap returns a remote that compresses content stored in r.
+func Wrap(r remote.RemoteV1) *Remote {
+	return &Remote{RemoteV1: r}
+}
+
+// Unwrap returns the wrapped remote.
+func (r *Remote) Unwrap() remote.RemoteV1 {
+	return r.RemoteV1
+}
+
+// ListConfigs returns the settings of the wrapper followed by those of the wrapped remote.
+func (r *Remote) ListConfigs(a remote.Annex) []remote.ConfigSetting {
+	configs := remote.NewConfig(&Config{}).ListConfigs()
+	var h remote.HasListConfigs
+	if remote.As(r.RemoteV1, &h) {
+		configs = append(configs, h.ListConfigs(a)...)
+	}
+	return configs
+}
+
+// Init validates the settings and initializes the wrapped remote.
+func (r *Remote) Init(a remote.Annex) error {
+	if err := remote.NewConfig(&r.Config).Load(a); err != nil {
+		return err
+	}
+	return r.RemoteV1.Init(a)
+}
+
+// Prepare loads the settings and prepares the wrapped remote.
+func (r *Remote) Prepare(a remote.Annex) error {
+	if err := remote.NewConfig(&r.Config).Load(a); err != nil {
+		return err
+	}
+	r.tmpDir = filepath.Join(a.GetGitDir(), "annex", "tmp")
+	return r.RemoteV1.Prepare(a)
+}
+
+func (r *Remote) tempFile() (*os.File, error) {
+	if err := os.MkdirAll(r.tmpDir, 0o700); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(r.tmpDir, "compress-")
+}
+
+// Store compresses the file and stores the result with the wrapped remote.
+func (r *Remote) Store(a remote.Annex, key, file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(in)
+	codec := codecsByName[r.Codec]
+	if prefix, _ := br.Peek(sniffLen); codec.id != IDNone && sniffCompressed(prefix) {
+		a.Debugf("%s appears to be compressed already; storing without compression", key)
+		codec = codecsByID[IDNone]
+	}
+
+	tmp, err := r.tempFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := compress(tmp, br, codec, r.Level); err != nil {
+		tmp.Close()
+		return err
+	}
+	compressed, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	a.Debugf("compressed %s with %s: %d -> %d bytes", key, codec.name, stat.Size(), compressed)
+
+	return r.RemoteV1.Store(&scaledAnnex{a, stat.Size(), compressed}, key, tmp.Name())
+}
+
+func compress(w io.Writer, r io.Reader, codec codecEntry, level int) error {
+	if _, err := w.Write(append([]byte(magic), codec.id)); err != nil {
+		return err
+	}
+	cw, err := codec.codec.NewWriter(w, level)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(cw, r); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+// Retrieve retrieves content from the wrapped remote and decompresses it into the file.
+func (r *Remote) Retrieve(a remote.Annex, key, file string) error {
+	tmp, err := r.tempFile()
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	// The wrapped remote reports progress in compressed bytes, which typically lag behind the
+	// uncompressed bytes reported while decompressing, so only report progress that advances.
+	ma := &monotonicAnnex{Annex: a}
+	if err := r.RemoteV1.Retrieve(ma, key, tmp.Name()); err != nil {
+		return err
+	}
+
+	in, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	pw := &progressWriter{w: out, a: ma}
+	if err := decompress(pw, bufio.NewReader(in)); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func decompress(w io.Writer, br *bufio.Reader) error {
+	header, _ := br.Peek(len(magic) + 1)
+	if len(header) < len(magic)+1 || !bytes.Equal(header[:len(magic)], []byte(magic)) {
+		// Stored without the wrapper.
+		_, err := io.Copy(w, br)
+		return err
+	}
+	codec, ok := codecsByID[header[len(magic)]]
+	if !ok {
+		return fmt.Errorf("content was stored with unknown compression codec %d", header[len(magic)])
+	}
+	if _, err := br.Discard(len(header)); err != nil {
+		return err
+	}
+	cr, err := codec.codec.NewReader(br)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+	_, err = io.Copy(w, cr)
+	return err
+}
+
+// scaledAnnex converts progress reported by the wrapped remote in terms of compressed bytes into
+// the corresponding number of uncompressed bytes, which is what git-annex expects.
+type scaledAnnex struct {
+	remote.Annex
+	size, compressed int64
+}
+
+func (s *scaledAnnex) Progress(bytes int) {
+	if s.compressed > 0 {
+		bytes = int(int64(bytes) * s.size / s.compressed)
+	}
+	s.Annex.Progress(bytes)
+}
+
+// monotonicAnnex drops progress reports that do not advance beyond the largest one so far.
+type monotonicAnnex struct {
+	remote.Annex
+	max int
+}
+
+func (m *monotonicAnnex) Progress(bytes int) {
+	if bytes > m.max {
+		m.max = bytes
+		m.Annex.Progress(bytes)
+	}
+}
+
+// progressWriter reports the number of bytes written through it as progress, at most once per
+// progressInterval bytes.
+type progressWriter struct {
+	w        io.Writer
+	a        remote.Annex
+	written  int64
+	reported int64
+}
+
+const progressInterval = 1 << 20
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	if p.written-p.reported >= progressInterval {
+		p.a.Progress(int(p.written))
+		p.reported = p.written
+	}
+	return n, err
+}
+
+// Statically ensure that the wrapper satisfies the interfaces used by the library.
+var (
+	_ remote.RemoteV1       = (*Remote)(nil)
+	_ remote.Unwrapper      = (*Remote)(nil)
+	_ remote.HasListConfigs = (*Remote)(nil)
+)
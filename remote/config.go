@@ -0,0 +1,390 @@
+package remote
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Config binds the fields of a tagged struct to the configuration settings of a remote. It can
+// generate the response to LISTCONFIGS, load and validate settings from git-annex with GETCONFIG,
+// and persist settings with SETCONFIG.
+//
+// Each exported field with a `config` tag corresponds to one setting. The tag holds the setting
+// name, optionally followed by ",required" if the setting must be given a value. The following
+// additional tags are recognized:
+//
+//	desc     the description of the setting reported by LISTCONFIGS
+//	default  the value used when the setting is unset
+//	enum     a comma-separated list of the values allowed for the setting
+//
+// Supported field types are strings, bools, signed and unsigned integers, floats, time.Duration,
+// Size, and any type implementing encoding.TextUnmarshaler (and, to be saved, also
+// encoding.TextMarshaler). If the struct implements `Validate() error`, it is called after all
+// fields have been loaded.
+//
+// Note that git-annex does not distinguish between a setting that is unset and one that is set to
+// the empty string, so both are treated as unset.
+type Config struct {
+	v      reflect.Value
+	fields []configField
+}
+
+type configField struct {
+	index    int
+	name     string
+	desc     string
+	def      string
+	enum     []string
+	required bool
+}
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+	errRequired       = errors.New("a value is required")
+	errUnknownSetting = errors.New("unknown setting")
+)
+
+// NewConfig returns a Config bound to the struct pointed to by ptr. It panics if ptr is not a
+// non-nil pointer to a struct or if the struct's tags are malformed, since those are programming
+// errors.
+func NewConfig(ptr interface{}) *Config {
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("remote.NewConfig: expected a non-nil pointer to a struct, got %T", ptr))
+	}
+	v = v.Elem()
+	t := v.Type()
+
+	c := &Config{v: v}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, ok := sf.Tag.Lookup("config")
+		if !ok || sf.PkgPath != "" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		f := configField{
+			index: i,
+			name:  parts[0],
+			desc:  sf.Tag.Get("desc"),
+			def:   sf.Tag.Get("default"),
+		}
+		if !validSettingName(f.name) {
+			panic(fmt.Sprintf("remote.NewConfig: invalid setting name %q for field %s", f.name, sf.Name))
+		}
+		for _, opt := range parts[1:] {
+			switch opt {
+			case "required":
+				f.required = true
+			default:
+				panic(fmt.Sprintf("remote.NewConfig: unknown option %q for field %s", opt, sf.Name))
+			}
+		}
+		if e := sf.Tag.Get("enum"); e != "" {
+			f.enum = strings.Split(e, ",")
+		}
+		if !settable(sf.Type) {
+			panic(fmt.Sprintf("remote.NewConfig: unsupported type %s for field %s", sf.Type, sf.Name))
+		}
+		c.fields = append(c.fields, f)
+	}
+	return c
+}
+
+func validSettingName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || r == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+func settable(t reflect.Type) bool {
+	if reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// ConfigError describes a configuration setting that could not be loaded.
+type ConfigError struct {
+	Setting string
+	Value   string
+	Err     error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("config setting %s: %v", e.Setting, e.Err)
+	}
+	return fmt.Sprintf("config setting %s: invalid value %q: %v", e.Setting, e.Value, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ListConfigs returns the settings described by the struct, suitable for returning from the
+// ListConfigs method of HasListConfigs.
+func (c *Config) ListConfigs() []ConfigSetting {
+	settings := make([]ConfigSetting, 0, len(c.fields))
+	for _, f := range c.fields {
+		desc := f.desc
+		if len(f.enum) > 0 {
+			desc += fmt.Sprintf(" (one of: %s)", strings.Join(f.enum, ", "))
+		}
+		if f.def != "" {
+			desc += fmt.Sprintf(" (default: %s)", f.def)
+		}
+		settings = append(settings, ConfigSetting{Name: f.name, Description: strings.TrimSpace(desc)})
+	}
+	return settings
+}
+
+// Load reads every setting from git-annex with GETCONFIG and stores the parsed values in the
+// struct. It is meant to be called from Init and Prepare; the returned error, if any, is a
+// *ConfigError describing the first setting that is missing or invalid, or the error returned by
+// the struct's Validate method.
+func (c *Config) Load(a Annex) error {
+	for _, f := range c.fields {
+		value := a.GetConfig(f.name)
+		if value == "" {
+			value = f.def
+		}
+		if value == "" {
+			if f.required {
+				return &ConfigError{Setting: f.name, Err: errRequired}
+			}
+			continue
+		}
+		if err := f.check(value); err != nil {
+			return &ConfigError{Setting: f.name, Value: value, Err: err}
+		}
+		if err := setField(c.v.Field(f.index), value); err != nil {
+			return &ConfigError{Setting: f.name, Value: value, Err: err}
+		}
+	}
+	if v, ok := c.v.Addr().Interface().(interface{ Validate() error }); ok {
+		return v.Validate()
+	}
+	return nil
+}
+
+// Save persists the current values of the named settings with SETCONFIG, so that they are
+// available the next time the remote is used. If no names are given, all settings are saved. It is
+// mainly useful during Init to record settings derived from other settings or chosen
+// automatically.
+func (c *Config) Save(a Annex, names ...string) error {
+	for _, name := range names {
+		if !c.has(name) {
+			return &ConfigError{Setting: name, Err: errUnknownSetting}
+		}
+	}
+	for _, f := range c.fields {
+		if len(names) > 0 && !contains(names, f.name) {
+			continue
+		}
+		value, err := formatField(c.v.Field(f.index))
+		if err != nil {
+			return &ConfigError{Setting: f.name, Err: err}
+		}
+		a.SetConfig(f.name, value)
+	}
+	return nil
+}
+
+func (c *Config) has(name string) bool {
+	for _, f := range c.fields {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *configField) check(value string) error {
+	if len(f.enum) == 0 || contains(f.enum, value) {
+		return nil
+	}
+	return fmt.Errorf("must be one of: %s", strings.Join(f.enum, ", "))
+}
+
+func setField(v reflect.Value, value string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := parseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	}
+	return nil
+}
+
+func formatField(v reflect.Value) (string, error) {
+	if m, ok := v.Addr().Interface().(encoding.TextMarshaler); ok {
+		b, err := m.MarshalText()
+		return string(b), err
+	}
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String(), nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		if v.Bool() {
+			return "yes", nil
+		}
+		return "no", nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits()), nil
+	}
+	return "", fmt.Errorf("cannot format value of type %s", v.Type())
+}
+
+// parseBool accepts the spellings git-annex itself uses for boolean settings in addition to those
+// accepted by strconv.ParseBool.
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "yes", "on":
+		return true, nil
+	case "no", "off":
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+// Size is a number of bytes that can be parsed from strings such as "1GiB", "500kB", or "1048576".
+// It can be used as a field type with Config.
+type Size int64
+
+var sizeUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"kB", 1e3}, {"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"k", 1 << 10}, {"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// ParseSize parses a size with an optional unit suffix. Binary (KiB, MiB, ...) and decimal (kB, MB,
+// ...) suffixes are supported; single-letter suffixes (k, M, ...) are treated as binary.
+func ParseSize(s string) (Size, error) {
+	s = strings.TrimSpace(s)
+	orig := s
+	mult := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative size %q", s)
+	}
+	// float64(math.MaxInt64) is 2^63, the first value that does not fit.
+	v := n * float64(mult)
+	if math.IsNaN(v) || v >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %q is out of range", orig)
+	}
+	return Size(v), nil
+}
+
+// String formats the size using the largest binary unit that represents it exactly.
+func (s Size) String() string {
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}} {
+		if s != 0 && int64(s)%u.mult == 0 {
+			return strconv.FormatInt(int64(s)/u.mult, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(int64(s), 10)
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *Size) UnmarshalText(text []byte) error {
+	n, err := ParseSize(string(text))
+	if err != nil {
+		return err
+	}
+	*s = n
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Size) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
@@ -0,0 +1,60 @@
+package remote
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Size
+	}{
+		{"0", 0},
+		{"1048576", 1 << 20},
+		{"100B", 100},
+		{"1KiB", 1 << 10},
+		{"1.5MiB", 3 << 19},
+		{"2GiB", 2 << 30},
+		{"1TiB", 1 << 40},
+		{"500kB", 500e3},
+		{"3MB", 3e6},
+		{"1GB", 1e9},
+		{"2TB", 2e12},
+		{"4k", 4 << 10},
+		{"4M", 4 << 20},
+		{" 10 MiB ", 10 << 20},
+		{"8388607TiB", 8388607 << 40},
+	} {
+		got, err := ParseSize(tc.in)
+		if err != nil {
+			t.Errorf("ParseSize(%q): %v", tc.in, err)
+		} else if got != tc.want {
+			t.Errorf("ParseSize(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+
+	for _, in := range []string{"", "MiB", "ten", "-1", "-1KiB", "1XB", "NaN", "Inf", "8388608TiB", "99999999999TB"} {
+		if got, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+func TestSizeString(t *testing.T) {
+	for _, tc := range []struct {
+		in   Size
+		want string
+	}{
+		{0, "0"},
+		{1000, "1000"},
+		{1 << 10, "1KiB"},
+		{3 << 19, "1536KiB"},
+		{5 << 30, "5GiB"},
+		{2 << 40, "2TiB"},
+	} {
+		if got := tc.in.String(); got != tc.want {
+			t.Errorf("Size(%d).String() = %q, want %q", int64(tc.in), got, tc.want)
+		}
+		if back, err := ParseSize(tc.in.String()); err != nil || back != tc.in {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", tc.in.String(), back, err, int64(tc.in))
+		}
+	}
+}
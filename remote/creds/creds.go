@@ -0,0 +1,220 @@
+// Package creds helps external special remotes obtain and store credentials. It layers the
+// conventions used by git-annex's built-in remotes on top of the SETCREDS and GETCREDS messages:
+// credentials may come from environment variables, from a credentials file, or from the creds
+// previously stored by git-annex.
+//
+// Where stored credentials are kept is decided by git-annex itself, not by this package: git-annex
+// handles the standard "embedcreds" setting for external special remotes, storing the credentials
+// sent with SETCREDS in the git-annex branch when embedcreds=yes and only locally otherwise. The
+// package therefore neither lists nor reads that setting.
+//
+// A remote typically declares a Spec, calls Spec.Init from its Init method and Spec.Load from its
+// Prepare method, and includes Spec.ListConfigs in its LISTCONFIGS response.
+package creds
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dzhu/go-git-annex-external/remote"
+)
+
+// Creds is a username and password pair. Its String method redacts the password, so it may be
+// logged safely.
+type Creds struct {
+	User, Password string
+}
+
+func (c Creds) String() string {
+	return fmt.Sprintf("{%s ***}", c.User)
+}
+
+// Source identifies where a pair of credentials was found.
+type Source string
+
+// The places credentials are looked for, in the order they are tried.
+const (
+	SourceEnv    Source = "environment"
+	SourceFile   Source = "file"
+	SourceStored Source = "stored"
+)
+
+// Spec describes where a remote's credentials may be found.
+type Spec struct {
+	// Setting is the name under which the credentials are stored with SETCREDS and GETCREDS.
+	Setting string
+	// UserEnv and PasswordEnv name the environment variables to read the credentials from. If
+	// either is empty, the environment is not consulted.
+	UserEnv, PasswordEnv string
+	// FileConfig names a config setting whose value is the path of a credentials file. As with
+	// git-annex's own creds files, the file contains the username on its first line and the
+	// password on its second. If empty, no credentials file is consulted.
+	FileConfig string
+}
+
+// MissingError is returned when credentials could not be found in any of the places they were
+// looked for.
+type MissingError struct {
+	Setting string
+	Tried   []Source
+}
+
+func (e *MissingError) Error() string {
+	tried := make([]string, len(e.Tried))
+	for i, s := range e.Tried {
+		tried[i] = string(s)
+	}
+	return fmt.Sprintf("no credentials found for %s (tried: %s)", e.Setting, strings.Join(tried, ", "))
+}
+
+// FileError is returned when the configured credentials file cannot be used.
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("reading credentials file %s: %v", e.Path, e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// ListConfigs returns the settings that control how credentials are found, for inclusion in a
+// remote's LISTCONFIGS response.
+func (s *Spec) ListConfigs() []remote.ConfigSetting {
+	var settings []remote.ConfigSetting
+	if s.FileConfig != "" {
+		settings = append(settings, remote.ConfigSetting{
+			Name:        s.FileConfig,
+			Description: "path of a file containing the username and password on separate lines",
+		})
+	}
+	return settings
+}
+
+// Init finds credentials for use during initialization of the remote and stores them with
+// SETCREDS, so that later uses of the remote (and, with embedcreds=yes, other clones of the
+// repository) can find them without the environment or file. It must be called from the remote's
+// Init method, since git-annex only accepts SETCREDS during INITREMOTE and ENABLEREMOTE.
+func (s *Spec) Init(a remote.Annex) (Creds, error) {
+	c, src, err := s.find(a)
+	if err != nil {
+		return Creds{}, err
+	}
+	if src != SourceStored {
+		a.Debugf("storing %s credentials from %s", s.Setting, src)
+		a.SetCreds(s.Setting, c.User, c.Password)
+	}
+	return c, nil
+}
+
+// Load finds credentials for normal use of the remote, without storing them. It is meant to be
+// called from the remote's Prepare method.
+func (s *Spec) Load(a remote.Annex) (Creds, error) {
+	c, src, err := s.find(a)
+	if err != nil {
+		return Creds{}, err
+	}
+	a.Debugf("using %s credentials from %s", s.Setting, src)
+	return c, nil
+}
+
+func (s *Spec) find(a remote.Annex) (Creds, Source, error) {
+	var tried []Source
+
+	if s.UserEnv != "" && s.PasswordEnv != "" {
+		tried = append(tried, SourceEnv)
+		user, okUser := os.LookupEnv(s.UserEnv)
+		password, okPassword := os.LookupEnv(s.PasswordEnv)
+		if okUser && okPassword {
+			return Creds{user, password}, SourceEnv, nil
+		}
+	}
+
+	if s.FileConfig != "" {
+		tried = append(tried, SourceFile)
+		if path := a.GetConfig(s.FileConfig); path != "" {
+			c, err := readFile(path)
+			if err != nil {
+				return Creds{}, "", &FileError{path, err}
+			}
+			return c, SourceFile, nil
+		}
+	}
+
+	tried = append(tried, SourceStored)
+	if user, password := a.GetCreds(s.Setting); user != "" || password != "" {
+		return Creds{user, password}, SourceStored, nil
+	}
+
+	return Creds{}, "", &MissingError{Setting: s.Setting, Tried: tried}
+}
+
+func readFile(path string) (Creds, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Creds{}, err
+	}
+	defer f.Close()
+
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() && len(lines) < 2 {
+		lines = append(lines, strings.TrimRight(s.Text(), "\r"))
+	}
+	if err := s.Err(); err != nil {
+		return Creds{}, err
+	}
+	if len(lines) < 2 {
+		return Creds{}, fmt.Errorf("expected username and password on separate lines")
+	}
+	return Creds{lines[0], lines[1]}, nil
+}
+
+// Redact wraps an Annex so that any of the given secrets appearing in DEBUG, INFO, or ERROR
+// messages are replaced with "***". Empty secrets are ignored.
+func Redact(a remote.Annex, secrets ...string) remote.Annex {
+	var pairs []string
+	for _, s := range secrets {
+		if s != "" {
+			pairs = append(pairs, s, "***")
+		}
+	}
+	if len(pairs) == 0 {
+		return a
+	}
+	return &redactingAnnex{Annex: a, r: strings.NewReplacer(pairs...)}
+}
+
+type redactingAnnex struct {
+	remote.Annex
+	r *strings.Replacer
+}
+
+func (r *redactingAnnex) Debug(message string) {
+	r.Annex.Debug(r.r.Replace(message))
+}
+
+func (r *redactingAnnex) Debugf(format string, args ...interface{}) {
+	r.Debug(fmt.Sprintf(format, args...))
+}
+
+func (r *redactingAnnex) Info(message string) {
+	r.Annex.Info(r.r.Replace(message))
+}
+
+func (r *redactingAnnex) Infof(format string, args ...interface{}) {
+	r.Info(fmt.Sprintf(format, args...))
+}
+
+func (r *redactingAnnex) Error(message string) {
+	r.Annex.Error(r.r.Replace(message))
+}
+
+func (r *redactingAnnex) Errorf(format string, args ...interface{}) {
+	r.Error(fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,268 @@
+// Package crypt provides a wrapper for external special remotes that encrypts content on the
+// client before it reaches the wrapped remote, so that the storage provider sees neither the
+// content nor (optionally) the names of the keys.
+//
+// Content is encrypted with AES-256-GCM in fixed-size segments, so memory use is constant
+// regardless of file size, and every segment is authenticated when it is retrieved. Keys are
+// derived from a random 256-bit key generated for the remote when it is initialized. Depending on
+// the "crypt" config setting, that key is either kept with the remote's creds (crypt=creds, the
+// default; combine with embedcreds=yes to make it available to other clones) or stored in the
+// remote's configuration in the git-annex branch (crypt=shared), where anyone with access to the
+// repository can read it.
+//
+// Unlike most wrappers, a crypt remote does not pass arbitrary optional interfaces through to the
+// wrapped remote, since interfaces such as HasExport would bypass encryption. It forwards only
+// those that do not involve content.
+package crypt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dzhu/go-git-annex-external/remote"
+)
+
+const (
+	keySize = 32
+
+	// credsSetting is the name under which the key is stored with SETCREDS.
+	credsSetting = "crypt"
+	// keyConfig is the setting under which the key is stored with SETCONFIG in shared mode.
+	keyConfig = "cryptkey"
+	// keyIDConfig is the setting recording a fingerprint of the key, used to detect a missing or
+	// mismatched key.
+	keyIDConfig = "cryptkeyid"
+)
+
+// Config is the configuration read by the wrapper.
+type Config struct {
+	Mode  string `config:"crypt" enum:"creds,shared" default:"creds" desc:"where to keep the encryption key"`
+	Names bool   `config:"cryptnames" default:"yes" desc:"hide key names from the remote with HMAC (yes or no)"`
+}
+
+// Remote wraps a remote to encrypt its content.
+type Remote struct {
+	inner remote.RemoteV1
+	Config
+
+	key    []byte
+	tmpDir string
+}
+
+// Wrap returns a remote that encrypts content stored in r.
+func Wrap(r remote.RemoteV1) *Remote {
+	return &Remote{inner: r}
+}
+
+func keyID(key []byte) string {
+	return hex.EncodeToString(deriveKey(key, "id", nil)[:8])
+}
+
+func (r *Remote) loadKey(a remote.Annex) ([]byte, error) {
+	var enc string
+	switch r.Mode {
+	case "shared":
+		enc = a.GetConfig(keyConfig)
+	default:
+		_, enc = a.GetCreds(credsSetting)
+	}
+	if enc == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil || len(key) != keySize {
+		return nil, errors.New("stored encryption key is malformed")
+	}
+	return key, nil
+}
+
+func (r *Remote) checkKey(a remote.Annex, key []byte) error {
+	id := a.GetConfig(keyIDConfig)
+	switch {
+	case key == nil && id != "":
+		return fmt.Errorf(
+			"encryption key %s is not available; enable the remote where its creds are stored, or use embedcreds=yes",
+			id)
+	case key == nil:
+		return errors.New("no encryption key; the remote must be initialized first")
+	case id != "" && id != keyID(key):
+		return fmt.Errorf("encryption key %s does not match expected key %s", keyID(key), id)
+	}
+	return nil
+}
+
+// ListConfigs returns the settings of the wrapper followed by those of the wrapped remote.
+func (r *Remote) ListConfigs(a remote.Annex) []remote.ConfigSetting {
+	configs := remote.NewConfig(&Config{}).ListConfigs()
+	var h remote.HasListConfigs
+	if remote.As(r.inner, &h) {
+		configs = append(configs, h.ListConfigs(a)...)
+	}
+	return configs
+}
+
+// Init generates and stores an encryption key, unless the remote already has one, and initializes
+// the wrapped remote.
+func (r *Remote) Init(a remote.Annex) error {
+	if err := remote.NewConfig(&r.Config).Load(a); err != nil {
+		return err
+	}
+	key, err := r.loadKey(a)
+	if err != nil {
+		return err
+	}
+	if key == nil && a.GetConfig(keyIDConfig) == "" {
+		key = make([]byte, keySize)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return err
+		}
+		a.Debugf("generated encryption key %s", keyID(key))
+		a.SetConfig(keyIDConfig, keyID(key))
+	}
+	if err := r.checkKey(a, key); err != nil {
+		return err
+	}
+	enc := base64.StdEncoding.EncodeToString(key)
+	switch r.Mode {
+	case "shared":
+		a.SetConfig(keyConfig, enc)
+	default:
+		a.SetCreds(credsSetting, "key", enc)
+	}
+	r.key = key
+	return r.inner.Init(a)
+}
+
+// Prepare loads the encryption key and prepares the wrapped remote.
+func (r *Remote) Prepare(a remote.Annex) error {
+	if err := remote.NewConfig(&r.Config).Load(a); err != nil {
+		return err
+	}
+	key, err := r.loadKey(a)
+	if err != nil {
+		return err
+	}
+	if err := r.checkKey(a, key); err != nil {
+		return err
+	}
+	r.key = key
+	r.tmpDir = filepath.Join(a.GetGitDir(), "annex", "tmp")
+	return r.inner.Prepare(a)
+}
+
+// innerKey returns the key under which content for the given key is stored in the wrapped remote.
+func (r *Remote) innerKey(key string) string {
+	if !r.Names {
+		return key
+	}
+	m := hmac.New(sha256.New, deriveKey(r.key, "names", nil))
+	m.Write([]byte(key))
+	return "XCRYPTHMACSHA256--" + hex.EncodeToString(m.Sum(nil))
+}
+
+func (r *Remote) tempFile() (*os.File, error) {
+	if err := os.MkdirAll(r.tmpDir, 0o700); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(r.tmpDir, "crypt-")
+}
+
+// Store encrypts the file and stores the result with the wrapped remote.
+func (r *Remote) Store(a remote.Annex, key, file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := r.tempFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := encrypt(r.key, tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return r.inner.Store(a, r.innerKey(key), tmp.Name())
+}
+
+// Retrieve retrieves encrypted content from the wrapped remote and decrypts it into the file.
+func (r *Remote) Retrieve(a remote.Annex, key, file string) error {
+	tmp, err := r.tempFile()
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := r.inner.Retrieve(a, r.innerKey(key), tmp.Name()); err != nil {
+		return err
+	}
+
+	in, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := decrypt(r.key, out, in); err != nil {
+		out.Close()
+		// Do not leave unauthenticated plaintext behind.
+		os.Remove(file)
+		return err
+	}
+	return out.Close()
+}
+
+// Present checks whether the wrapped remote has the encrypted content for the key.
+func (r *Remote) Present(a remote.Annex, key string) (bool, error) {
+	return r.inner.Present(a, r.innerKey(key))
+}
+
+// Remove removes the encrypted content for the key from the wrapped remote.
+func (r *Remote) Remove(a remote.Annex, key string) error {
+	return r.inner.Remove(a, r.innerKey(key))
+}
+
+// Extensions forwards to the wrapped remote, if it supports EXTENSIONS.
+func (r *Remote) Extensions(a remote.Annex, es []string) []string {
+	var h remote.HasExtensions
+	if !remote.As(r.inner, &h) {
+		return nil
+	}
+	return h.Extensions(a, es)
+}
+
+// GetInfo reports the encryption settings along with the info from the wrapped remote.
+func (r *Remote) GetInfo(a remote.Annex) []remote.InfoField {
+	info := []remote.InfoField{
+		{Name: "encryption", Value: fmt.Sprintf("AES-256-GCM (%s key %s)", r.Mode, a.GetConfig(keyIDConfig))},
+	}
+	var h remote.HasGetInfo
+	if remote.As(r.inner, &h) {
+		info = append(info, h.GetInfo(a)...)
+	}
+	return info
+}
+
+// Statically ensure that the wrapper satisfies the interfaces used by the library.
+var (
+	_ remote.RemoteV1       = (*Remote)(nil)
+	_ remote.HasListConfigs = (*Remote)(nil)
+	_ remote.HasExtensions  = (*Remote)(nil)
+	_ remote.HasGetInfo     = (*Remote)(nil)
+)
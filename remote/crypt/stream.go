@@ -0,0 +1,153 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The encrypted format consists of a header followed by a sequence of segments. The header holds a
+// magic string identifying the format and its version, a random salt from which the key for the
+// object is derived, and the plaintext segment size. Each segment is up to segmentSize bytes of
+// plaintext sealed with AES-256-GCM; its nonce holds the segment index and a flag marking the
+// final segment, so that reordered, duplicated, or truncated segments fail authentication. The
+// header is authenticated as additional data with every segment.
+
+const (
+	magic       = "GAXCRYPT\x01"
+	saltSize    = 32
+	headerSize  = len(magic) + saltSize + 4
+	segmentSize = 64 << 10
+	tagSize     = 16
+)
+
+// ErrAuth is returned when encrypted content fails authentication, meaning that it was corrupted
+// or tampered with or that it was encrypted with a different key.
+var ErrAuth = errors.New("encrypted content failed authentication")
+
+func deriveKey(key []byte, label string, data []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(label))
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+func newAEAD(key, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(key, "content", salt))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(aead cipher.AEAD, index uint64, final bool) []byte {
+	n := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(n, index)
+	if final {
+		n[len(n)-1] = 1
+	}
+	return n
+}
+
+// encrypt reads plaintext from r and writes the encrypted form to w, using memory proportional to
+// the segment size.
+func encrypt(key []byte, w io.Writer, r io.Reader) error {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	salt := header[len(magic) : len(magic)+saltSize]
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(header[len(magic)+saltSize:], segmentSize)
+	aead, err := newAEAD(key, salt)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	// Read one segment ahead so that the final segment can be identified before it is sealed.
+	cur := make([]byte, segmentSize)
+	next := make([]byte, segmentSize)
+	out := make([]byte, 0, segmentSize+tagSize)
+	n, err := io.ReadFull(r, cur)
+	for index := uint64(0); ; index++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		final := err != nil
+		var m int
+		if !final {
+			m, err = io.ReadFull(r, next)
+			if err == io.EOF {
+				final = true
+			}
+		}
+		out = aead.Seal(out[:0], nonce(aead, index, final), cur[:n], header)
+		if _, werr := w.Write(out); werr != nil {
+			return werr
+		}
+		if final {
+			return nil
+		}
+		cur, next, n = next, cur, m
+	}
+}
+
+// decrypt reads the encrypted form from r and writes the plaintext to w, checking authentication
+// of each segment before writing it.
+func decrypt(key []byte, w io.Writer, r io.Reader) error {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	if !bytes.Equal(header[:len(magic)], []byte(magic)) {
+		return errors.New("content is not in a supported encrypted format")
+	}
+	salt := header[len(magic) : len(magic)+saltSize]
+	segSize := int(binary.BigEndian.Uint32(header[len(magic)+saltSize:]))
+	if segSize <= 0 || segSize > 16<<20 {
+		return fmt.Errorf("invalid segment size %d", segSize)
+	}
+	aead, err := newAEAD(key, salt)
+	if err != nil {
+		return err
+	}
+
+	cur := make([]byte, segSize+tagSize)
+	next := make([]byte, segSize+tagSize)
+	out := make([]byte, 0, segSize)
+	n, err := io.ReadFull(r, cur)
+	for index := uint64(0); ; index++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		final := err != nil
+		var m int
+		if !final {
+			m, err = io.ReadFull(r, next)
+			if err == io.EOF {
+				final = true
+			}
+		}
+		var oerr error
+		if out, oerr = aead.Open(out[:0], nonce(aead, index, final), cur[:n], header); oerr != nil {
+			return ErrAuth
+		}
+		if _, werr := w.Write(out); werr != nil {
+			return werr
+		}
+		if final {
+			return nil
+		}
+		cur, next, n = next, cur, m
+	}
+}
@@ -0,0 +1,142 @@
+package crypt
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{7}, 32)
+
+func encryptBytes(t *testing.T, plaintext []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encrypt(testKey, &buf, bytes.NewReader(plaintext)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decryptBytes(key, ciphertext []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	err := decrypt(key, &buf, bytes.NewReader(ciphertext))
+	return buf.Bytes(), err
+}
+
+func plaintext(n int) []byte {
+	p := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(p)
+	return p
+}
+
+// segment returns the bounds of the sealed segment with the given index.
+func segment(index int) (start, end int) {
+	start = headerSize + index*(segmentSize+tagSize)
+	return start, start + segmentSize + tagSize
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3 * segmentSize, 3*segmentSize + 100} {
+		p := plaintext(n)
+		c := encryptBytes(t, p)
+		segments := (n + segmentSize - 1) / segmentSize
+		if segments == 0 {
+			segments = 1
+		}
+		if want := headerSize + n + segments*tagSize; len(c) != want {
+			t.Errorf("%d bytes: encrypted to %d bytes, want %d", n, len(c), want)
+		}
+		got, err := decryptBytes(testKey, c)
+		if err != nil {
+			t.Errorf("%d bytes: %v", n, err)
+		} else if !bytes.Equal(got, p) {
+			t.Errorf("%d bytes: decrypted content differs", n)
+		}
+	}
+}
+
+func TestSaltIsRandom(t *testing.T) {
+	p := plaintext(100)
+	if bytes.Equal(encryptBytes(t, p), encryptBytes(t, p)) {
+		t.Error("encrypting the same content twice gave the same result")
+	}
+}
+
+func TestTampering(t *testing.T) {
+	p := plaintext(3*segmentSize + 100)
+	c := encryptBytes(t, p)
+	s0, e0 := segment(0)
+	s1, e1 := segment(1)
+	s2, e2 := segment(2)
+
+	swap := func(c []byte) []byte {
+		out := append([]byte(nil), c[:s0]...)
+		out = append(out, c[s1:e1]...)
+		out = append(out, c[s0:e0]...)
+		return append(out, c[s2:]...)
+	}
+	concat := func(parts ...[]byte) []byte {
+		var out []byte
+		for _, part := range parts {
+			out = append(out, part...)
+		}
+		return out
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(c []byte) []byte
+		// auth is set if the failure must be reported as ErrAuth.
+		auth bool
+	}{
+		{"flip a bit in the salt", func(c []byte) []byte { c[len(magic)] ^= 1; return c }, true},
+		{"flip a bit in the first segment", func(c []byte) []byte { c[s0+10] ^= 1; return c }, true},
+		{"flip a bit in a tag", func(c []byte) []byte { c[e1-1] ^= 1; return c }, true},
+		{"flip a bit in the final segment", func(c []byte) []byte { c[len(c)-20] ^= 1; return c }, true},
+		{"swap the first two segments", swap, true},
+		{"duplicate a segment", func(c []byte) []byte { return concat(c[:e1], c[s1:]) }, true},
+		{"drop a middle segment", func(c []byte) []byte { return concat(c[:e0], c[s2:]) }, true},
+		{"truncate at a segment boundary", func(c []byte) []byte { return c[:e2] }, true},
+		{"truncate after the first segment", func(c []byte) []byte { return c[:e0] }, true},
+		{"truncate within a segment", func(c []byte) []byte { return c[:s2+100] }, true},
+		{"truncate after the header", func(c []byte) []byte { return c[:headerSize] }, true},
+		{"append a segment", func(c []byte) []byte { return concat(c, c[s1:e1]) }, true},
+		{"append a byte", func(c []byte) []byte { return append(c, 0) }, true},
+		{"truncate within the header", func(c []byte) []byte { return c[:headerSize-1] }, false},
+		{"change the magic string", func(c []byte) []byte { c[0] ^= 1; return c }, false},
+		{"change the segment size", func(c []byte) []byte { c[headerSize-1] ^= 1; return c }, false},
+	} {
+		modified := tc.modify(append([]byte(nil), c...))
+		_, err := decryptBytes(testKey, modified)
+		switch {
+		case err == nil:
+			t.Errorf("%s: decryption succeeded", tc.name)
+		case tc.auth && !errors.Is(err, ErrAuth):
+			t.Errorf("%s: got %v, want %v", tc.name, err, ErrAuth)
+		}
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	c := encryptBytes(t, plaintext(100))
+	other := bytes.Repeat([]byte{8}, 32)
+	if _, err := decryptBytes(other, c); !errors.Is(err, ErrAuth) {
+		t.Errorf("decrypting with the wrong key: got %v, want %v", err, ErrAuth)
+	}
+}
+
+func TestNoPlaintextBeforeAuthentication(t *testing.T) {
+	p := plaintext(2 * segmentSize)
+	c := encryptBytes(t, p)
+	_, e0 := segment(0)
+	c[e0+10] ^= 1
+	got, err := decryptBytes(testKey, c)
+	if !errors.Is(err, ErrAuth) {
+		t.Fatalf("got %v, want %v", err, ErrAuth)
+	}
+	// Segments before the damaged one may be written, but nothing from the damaged one.
+	if len(got) > segmentSize || !bytes.Equal(got, p[:len(got)]) {
+		t.Errorf("wrote %d bytes of plaintext, including unauthenticated content", len(got))
+	}
+}
@@ -0,0 +1,303 @@
+// Package dedup provides a wrapper for external special remotes that splits content into
+// content-defined chunks (see the cdc package) and stores each distinct chunk only once, so that
+// near-duplicate files, such as successive versions of a disk image or dataset, share most of their
+// storage.
+//
+// Each chunk is stored in the wrapped remote under a key named by its SHA-256 hash, of the form
+// "XDEDUP-s<size>--<hash>"; chunks that the wrapped remote already has are not stored again. A
+// manifest listing the chunks of the key (see cdc.Manifest) is stored under a key of the form
+// "XDEDUPMANIFEST--<hash>", named by the SHA-256 hash of the key, so manifests are never confused
+// with content. The average chunk size is taken from the "dedupchunk" config setting, which may be
+// at most 64MiB; since every manifest lists the sizes of its chunks, changing the setting does not
+// affect content that is already stored, though chunks stored with different settings are
+// unlikely to be shared. Keys stored before the wrapper was introduced, which have no manifest,
+// are retrieved unchanged.
+//
+// A key is considered present if its manifest is; its chunks were checked when it was stored.
+// Because chunks may be shared between keys, removing a key removes only its manifest and leaves
+// its chunks in the wrapped remote.
+//
+// Content stored by a backend.CDCBackend using SHA-256 and the same chunk sizes is split into the
+// same chunks.
+package dedup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dzhu/go-git-annex-external/cdc"
+	"github.com/dzhu/go-git-annex-external/key"
+	"github.com/dzhu/go-git-annex-external/remote"
+)
+
+// Backend names of the keys under which chunks and manifests are stored.
+const (
+	chunkBackend    = "XDEDUP"
+	manifestBackend = "XDEDUPMANIFEST"
+)
+
+// MaxChunkSize is the largest allowed value of the dedupchunk setting. Chunks may be up to four
+// times as large, and each is held in memory while it is stored.
+const MaxChunkSize = 64 << 20
+
+// Config is the configuration read by the wrapper.
+type Config struct {
+	ChunkSize remote.Size `config:"dedupchunk" default:"1MiB" desc:"average size of the chunks content is split into"`
+}
+
+// Validate checks that the chunk size is usable.
+func (c *Config) Validate() error {
+	if c.ChunkSize > MaxChunkSize {
+		return fmt.Errorf("dedupchunk %d is larger than the maximum of %d", c.ChunkSize, MaxChunkSize)
+	}
+	return c.params().Validate()
+}
+
+func (c *Config) params() cdc.Params {
+	return cdc.ParamsForAverage(int(c.ChunkSize))
+}
+
+// Remote wraps a remote to deduplicate its content.
+type Remote struct {
+	remote.RemoteV1
+	Config
+
+	tmpDir string
+}
+
+// Wrap returns a remote that deduplicates content stored in r.
+func Wrap(r remote.RemoteV1) *Remote {
+	return &Remote{RemoteV1: r}
+}
+
+// Unwrap returns the wrapped remote.
+func (r *Remote) Unwrap() remote.RemoteV1 {
+	return r.RemoteV1
+}
+
+// ListConfigs returns the settings of the wrapper followed by those of the wrapped remote.
+func (r *Remote) ListConfigs(a remote.Annex) []remote.ConfigSetting {
+	configs := remote.NewConfig(&Config{}).ListConfigs()
+	var h remote.HasListConfigs
+	if remote.As(r.RemoteV1, &h) {
+		configs = append(configs, h.ListConfigs(a)...)
+	}
+	return configs
+}
+
+// Init validates the settings and initializes the wrapped remote.
+func (r *Remote) Init(a remote.Annex) error {
+	if err := remote.NewConfig(&r.Config).Load(a); err != nil {
+		return err
+	}
+	return r.RemoteV1.Init(a)
+}
+
+// Prepare loads the settings and prepares the wrapped remote.
+func (r *Remote) Prepare(a remote.Annex) error {
+	if err := remote.NewConfig(&r.Config).Load(a); err != nil {
+		return err
+	}
+	r.tmpDir = filepath.Join(a.GetGitDir(), "annex", "tmp")
+	return r.RemoteV1.Prepare(a)
+}
+
+func (r *Remote) tempFile() (string, error) {
+	if err := os.MkdirAll(r.tmpDir, 0o700); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(r.tmpDir, "dedup-")
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// ChunkKey returns the key under which the chunk is stored in the wrapped remote.
+func ChunkKey(c cdc.Chunk) string {
+	return key.Key{Backend: chunkBackend, Size: c.Size, HasSize: true, Name: hex.EncodeToString(c.Sum)}.String()
+}
+
+// ManifestKey returns the key under which the manifest of the key is stored in the wrapped remote.
+func ManifestKey(k string) string {
+	sum := sha256.Sum256([]byte(k))
+	return key.Key{Backend: manifestBackend, Name: hex.EncodeToString(sum[:])}.String()
+}
+
+// Store splits the file into chunks, stores those that the wrapped remote does not already have,
+// and then stores the manifest.
+func (r *Remote) Store(a remote.Annex, key, file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := r.tempFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	var offset, shared int64
+	seen := make(map[string]bool)
+	m, err := cdc.Build(in, r.params(), sha256.New(), func(data []byte, c cdc.Chunk) error {
+		ck := ChunkKey(c)
+		if seen[ck] {
+			shared += c.Size
+		} else if present, err := r.RemoteV1.Present(a, ck); err == nil && present {
+			shared += c.Size
+		} else {
+			if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+				return err
+			}
+			if err := r.RemoteV1.Store(&progressAnnex{a, offset}, ck, tmp); err != nil {
+				return fmt.Errorf("storing chunk %s: %w", ck, err)
+			}
+		}
+		seen[ck] = true
+		offset += c.Size
+		a.Progress(int(offset))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	a.Debugf("stored %s as %d chunks; %d of %d bytes were already stored", key, len(m), shared, offset)
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return r.RemoteV1.Store(quietAnnex{a}, ManifestKey(key), tmp)
+}
+
+// manifest retrieves the manifest of the key, using the temporary file.
+func (r *Remote) manifest(a remote.Annex, key, tmp string) (cdc.Manifest, error) {
+	if err := r.RemoteV1.Retrieve(quietAnnex{a}, ManifestKey(key), tmp); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := cdc.ReadManifest(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest of %s: %w", key, err)
+	}
+	return m, nil
+}
+
+// Retrieve retrieves the manifest of the key and then each of its chunks, checking the hash of
+// each one, and reassembles them into the file. A key without a manifest, stored without the
+// wrapper, is retrieved from the wrapped remote unchanged.
+func (r *Remote) Retrieve(a remote.Annex, key, file string) error {
+	ok, err := r.RemoteV1.Present(a, ManifestKey(key))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return r.RemoteV1.Retrieve(a, key, file)
+	}
+
+	tmp, err := r.tempFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	m, err := r.manifest(a, key, tmp)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := r.assemble(a, out, m, tmp); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (r *Remote) assemble(a remote.Annex, out io.Writer, m cdc.Manifest, tmp string) error {
+	var offset int64
+	for i, c := range m {
+		ck := ChunkKey(c)
+		if err := r.RemoteV1.Retrieve(&progressAnnex{a, offset}, ck, tmp); err != nil {
+			return fmt.Errorf("retrieving chunk %d/%d (%s): %w", i+1, len(m), ck, err)
+		}
+		h := sha256.New()
+		in, err := os.Open(tmp)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(io.MultiWriter(out, h), in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+		if n != c.Size || !bytes.Equal(h.Sum(nil), c.Sum) {
+			return fmt.Errorf("chunk %d/%d (%s) does not match its key", i+1, len(m), ck)
+		}
+		offset += n
+		a.Progress(int(offset))
+	}
+	return nil
+}
+
+// Present checks whether the wrapped remote has the manifest of the key, or the key itself if it
+// was stored without the wrapper.
+func (r *Remote) Present(a remote.Annex, key string) (bool, error) {
+	present, err := r.RemoteV1.Present(a, ManifestKey(key))
+	if err != nil || present {
+		return present, err
+	}
+	return r.RemoteV1.Present(a, key)
+}
+
+// Remove removes the manifest of the key from the wrapped remote, along with the key itself in
+// case it was stored without the wrapper. Its chunks are left in place, since they may be shared
+// with other keys.
+func (r *Remote) Remove(a remote.Annex, key string) error {
+	if err := r.RemoteV1.Remove(a, ManifestKey(key)); err != nil {
+		return err
+	}
+	return r.RemoteV1.Remove(a, key)
+}
+
+// progressAnnex offsets the progress reported by the wrapped remote for one chunk by the amount of
+// data in the preceding chunks.
+type progressAnnex struct {
+	remote.Annex
+	offset int64
+}
+
+func (p *progressAnnex) Progress(bytes int) {
+	p.Annex.Progress(int(p.offset) + bytes)
+}
+
+// quietAnnex discards the progress reported by the wrapped remote while it transfers manifests,
+// which are not part of the content.
+type quietAnnex struct {
+	remote.Annex
+}
+
+func (quietAnnex) Progress(int) {}
+
+// Statically ensure that the wrapper satisfies the interfaces used by the library.
+var (
+	_ remote.RemoteV1       = (*Remote)(nil)
+	_ remote.Unwrapper      = (*Remote)(nil)
+	_ remote.HasListConfigs = (*Remote)(nil)
+)
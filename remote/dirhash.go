@@ -0,0 +1,26 @@
+package remote
+
+import "github.com/dzhu/go-git-annex-external/key"
+
+// HashDirMixed returns the same hash directory for the key, such as "pX/ZJ/", as Annex.DirHash, but
+// computes it locally instead of asking git-annex. As git-annex does, it hashes the key without its
+// chunk fields; a key that cannot be parsed, such as one with a field this library does not know,
+// is hashed as given, which matches git-annex unless the key is a chunk key.
+func HashDirMixed(k string) string {
+	return key.HashDirMixed(nonChunk(k))
+}
+
+// HashDirLower returns the same hash directory for the key, such as "f87/4d5/", as
+// Annex.DirHashLower, but computes it locally instead of asking git-annex. Keys are hashed as by
+// HashDirMixed.
+func HashDirLower(k string) string {
+	return key.HashDirLower(nonChunk(k))
+}
+
+func nonChunk(k string) string {
+	parsed, err := key.Parse(k)
+	if err != nil {
+		return k
+	}
+	return parsed.NonChunk().String()
+}
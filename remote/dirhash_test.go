@@ -0,0 +1,31 @@
+package remote
+
+import "testing"
+
+func TestHashDir(t *testing.T) {
+	for _, tc := range []struct {
+		key, mixed, lower string
+	}{
+		// The example used throughout the git-annex documentation.
+		{"SHA256E-s0--e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "pX/ZJ/", "f87/4d5/"},
+		{"MD5-s12--6f5902ac237024bdd0c176cb93063dc4", "83/Z4/", "034/ad6/"},
+		{"XSHORTHASH-s5--0123456789abcdef", "zg/91/", "921/aa4/"},
+		{
+			"SHA256E-s1048576--3b2e7f5b8e0d3f7a0a1c2b4d6e8f00112233445566778899aabbccddeeff0011.tar.gz",
+			"V1/5J/", "c17/695/",
+		},
+		{"WORM-s1024-m1700000000--photo.jpg", "5v/MK/", "509/1e9/"},
+		// Chunk keys are stored in the directory of the whole content.
+		{"SHA256E-s0-S1024-C1--e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "pX/ZJ/", "f87/4d5/"},
+		{"WORM-s1024-m1700000000-S100-C11--photo.jpg", "5v/MK/", "509/1e9/"},
+		// Keys with fields that are not known are hashed as given rather than put at the root.
+		{"SHA256-s0-X1--e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "Gz/G6/", "6a6/7f4/"},
+	} {
+		if got := HashDirMixed(tc.key); got != tc.mixed {
+			t.Errorf("HashDirMixed(%q) = %q, want %q", tc.key, got, tc.mixed)
+		}
+		if got := HashDirLower(tc.key); got != tc.lower {
+			t.Errorf("HashDirLower(%q) = %q, want %q", tc.key, got, tc.lower)
+		}
+	}
+}
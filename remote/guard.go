@@ -0,0 +1,149 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Names of the standard config settings, handled by the library for every remote, that put the
+// remote into read-only or dry-run mode. The read-only setting is not named "readonly", since
+// readonly=true is a setting of git-annex itself with which it never runs the remote's program.
+const (
+	ReadOnlyConfig = "readonlyguard"
+	DryRunConfig   = "dryrun"
+)
+
+// Mode restricts the operations a remote performs.
+type Mode int
+
+const (
+	// ModeNormal performs all operations.
+	ModeNormal Mode = iota
+	// ModeDryRun logs the operations that would modify the remote, without performing them, and
+	// reports them as failed so that git-annex does not record changes that did not happen.
+	ModeDryRun
+	// ModeReadOnly refuses the operations that would modify the remote.
+	ModeReadOnly
+)
+
+// ErrReadOnly is returned for operations refused by a remote in read-only mode.
+var ErrReadOnly = errors.New("remote is read-only")
+
+// ErrDryRun is returned for operations skipped by a remote in dry-run mode.
+var ErrDryRun = errors.New("skipped in dry-run mode")
+
+// GuardedRemote is a remote restricted to a Mode. Create one with ReadOnly or DryRun.
+//
+// Besides wrapping a remote explicitly, any remote run with Run can be switched into these modes
+// by setting the readonlyguard or dryrun config settings to yes; the library then applies the
+// restrictions itself. The restrictions cover Store and Remove as well as the export operations
+// that modify the remote (storing, removing, and renaming exported files and removing exported
+// directories). Retrieval and presence checks are always allowed.
+type GuardedRemote struct {
+	RemoteV1
+	mode Mode
+}
+
+// ReadOnly returns a remote that behaves like r but refuses to modify its contents.
+func ReadOnly(r RemoteV1) *GuardedRemote {
+	return &GuardedRemote{RemoteV1: r, mode: ModeReadOnly}
+}
+
+// DryRun returns a remote that behaves like r but only logs the modifications it would make.
+func DryRun(r RemoteV1) *GuardedRemote {
+	return &GuardedRemote{RemoteV1: r, mode: ModeDryRun}
+}
+
+// Unwrap returns the wrapped remote.
+func (g *GuardedRemote) Unwrap() RemoteV1 {
+	return g.RemoteV1
+}
+
+// Store refuses or logs the store according to the remote's mode.
+func (g *GuardedRemote) Store(a Annex, key, file string) error {
+	if err := guard(a, g.mode, "store %s", key); err != nil {
+		return err
+	}
+	return g.RemoteV1.Store(a, key, file)
+}
+
+// Remove refuses or logs the removal according to the remote's mode.
+func (g *GuardedRemote) Remove(a Annex, key string) error {
+	if err := guard(a, g.mode, "remove %s", key); err != nil {
+		return err
+	}
+	return g.RemoteV1.Remove(a, key)
+}
+
+// guard returns the error for performing the described operation in the given mode, logging it
+// in dry-run mode.
+func guard(a Annex, mode Mode, format string, args ...interface{}) error {
+	switch mode {
+	case ModeReadOnly:
+		return fmt.Errorf("cannot %s: %w", fmt.Sprintf(format, args...), ErrReadOnly)
+	case ModeDryRun:
+		op := fmt.Sprintf(format, args...)
+		a.Infof("dry run: would %s", op)
+		return fmt.Errorf("%s: %w", op, ErrDryRun)
+	}
+	return nil
+}
+
+// modeState holds the mode set through config, shared by all jobs of a running remote.
+type modeState struct {
+	mu   sync.Mutex
+	mode Mode
+}
+
+func (m *modeState) load(a Annex) error {
+	mode := ModeNormal
+	for _, s := range []struct {
+		name string
+		mode Mode
+	}{{DryRunConfig, ModeDryRun}, {ReadOnlyConfig, ModeReadOnly}} {
+		value := a.GetConfig(s.name)
+		if value == "" {
+			continue
+		}
+		on, err := parseBool(value)
+		if err != nil {
+			return &ConfigError{Setting: s.name, Value: value, Err: err}
+		}
+		if on {
+			mode = s.mode
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mode = mode
+	return nil
+}
+
+// modeOf returns the most restrictive of the configured mode and the modes of any GuardedRemotes
+// in the chain starting at r.
+func (m *modeState) modeOf(r RemoteV1) Mode {
+	m.mu.Lock()
+	mode := m.mode
+	m.mu.Unlock()
+	for r != nil {
+		if g, ok := r.(*GuardedRemote); ok && g.mode > mode {
+			mode = g.mode
+		}
+		u, ok := r.(Unwrapper)
+		if !ok {
+			break
+		}
+		r = u.Unwrap()
+	}
+	return mode
+}
+
+func (a *annexIO) guard(format string, args ...interface{}) error {
+	return guard(a, a.mode.modeOf(a.impl), format, args...)
+}
+
+var guardConfigs = []ConfigSetting{
+	{Name: ReadOnlyConfig, Description: "refuse to modify the contents of the remote (yes or no)"},
+	{Name: DryRunConfig, Description: "log modifications to the remote instead of making them (yes or no)"},
+}
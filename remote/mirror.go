@@ -0,0 +1,328 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// MirrorRemote is a remote that replicates content across several inner remotes, so that they can
+// be used together as a single git-annex special remote. Create one with Mirror.
+//
+// Store stores to every inner remote and succeeds if at least Quorum of them succeed. Retrieve
+// tries the inner remotes in order, deferring those that have failed recently, until one succeeds.
+// Present reports the key as present if at least Quorum inner remotes have it. Remove removes the
+// key from every inner remote and succeeds only if all of them succeed, since a copy left behind
+// would otherwise be forgotten.
+//
+// Optional interfaces of the inner remotes are not passed through, except that the config
+// settings of all inner remotes are listed.
+//
+// The inner remotes share the remote's Annex, so each one keeps its per-key state in its own
+// namespace of the remote's state, named by its entry in Names, as State values of different names
+// are. State stored by the primary before it was mirrored remains readable. Each replica is also
+// given its own namespace of the rest of the Annex, named by its entry in Names followed by "-"
+// (for example, "replica1-"), while the primary sees the rest unchanged:
+//   - The replica's config settings and creds are stored under names with the prefix. When reading
+//     a setting, a value set for the prefixed name takes precedence over the shared one, so
+//     replica1-directory=/mnt/b can override directory=/mnt/a. The prefixed names are listed
+//     along with the shared ones.
+//   - The replica's UUID has the name appended, so that files kept per remote, such as the index
+//     of the presence package, are distinct.
+//
+// URLs and URIs recorded with SetURLPresent and its relatives are not namespaced, since git-annex
+// records them for the remote as a whole.
+type MirrorRemote struct {
+	// Quorum is the number of inner remotes that must succeed for Store and agree for Present. If it
+	// is zero or exceeds the number of inner remotes, all inner remotes are required.
+	Quorum int
+	// Names are the names of the inner remotes used in messages and info. They default to
+	// "primary" and "replica1", "replica2", and so on.
+	Names []string
+
+	remotes []RemoteV1
+	mu      sync.Mutex
+	health  []mirrorHealth
+}
+
+type mirrorHealth struct {
+	lastErr string
+	failed  bool
+}
+
+// Mirror returns a remote that replicates content across the primary and replica remotes. The
+// quorum initially requires all of them; set the Quorum field to change that.
+func Mirror(primary RemoteV1, replicas ...RemoteV1) *MirrorRemote {
+	m := &MirrorRemote{remotes: append([]RemoteV1{primary}, replicas...)}
+	m.health = make([]mirrorHealth, len(m.remotes))
+	m.Names = []string{"primary"}
+	for i := range replicas {
+		m.Names = append(m.Names, fmt.Sprintf("replica%d", i+1))
+	}
+	return m
+}
+
+func (m *MirrorRemote) quorum() int {
+	if m.Quorum <= 0 || m.Quorum > len(m.remotes) {
+		return len(m.remotes)
+	}
+	return m.Quorum
+}
+
+func (m *MirrorRemote) name(i int) string {
+	if i < len(m.Names) {
+		return m.Names[i]
+	}
+	return fmt.Sprintf("remote%d", i)
+}
+
+// annex returns the Annex for inner remote i.
+func (m *MirrorRemote) annex(a Annex, i int) Annex {
+	name := m.name(i)
+	if i == 0 {
+		return stateNamespaceAnnex{a, name}
+	}
+	return &replicaAnnex{stateNamespaceAnnex{a, name}, name + "-"}
+}
+
+func (m *MirrorRemote) failed(i int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.health[i].failed
+}
+
+func (m *MirrorRemote) setHealth(i int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.health[i] = mirrorHealth{lastErr: err.Error(), failed: true}
+	} else {
+		m.health[i] = mirrorHealth{}
+	}
+}
+
+// mirrorErrors collects the errors of the inner remotes for one operation.
+type mirrorErrors []string
+
+func (e *mirrorErrors) add(name string, err error) {
+	*e = append(*e, fmt.Sprintf("%s: %v", name, err))
+}
+
+func (e mirrorErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(e, "; "))
+}
+
+// Init initializes every inner remote.
+func (m *MirrorRemote) Init(a Annex) error {
+	var errs mirrorErrors
+	for i, r := range m.remotes {
+		if err := r.Init(m.annex(a, i)); err != nil {
+			errs.add(m.name(i), err)
+		}
+	}
+	return errs.err()
+}
+
+// Prepare prepares every inner remote. It fails only if fewer than Quorum inner remotes could be
+// prepared; those that could not are considered unhealthy.
+func (m *MirrorRemote) Prepare(a Annex) error {
+	var errs mirrorErrors
+	for i, r := range m.remotes {
+		err := r.Prepare(m.annex(a, i))
+		m.setHealth(i, err)
+		if err != nil {
+			a.Debugf("preparing %s: %v", m.name(i), err)
+			errs.add(m.name(i), err)
+		}
+	}
+	if len(m.remotes)-len(errs) < m.quorum() {
+		return errs.err()
+	}
+	return nil
+}
+
+// Store stores the key in every inner remote.
+func (m *MirrorRemote) Store(a Annex, key, file string) error {
+	var size int64
+	if stat, err := os.Stat(file); err == nil {
+		size = stat.Size()
+	}
+	var errs mirrorErrors
+	stored := 0
+	for i, r := range m.remotes {
+		pa := &mirrorProgressAnnex{Annex: m.annex(a, i), base: int64(i) * size, parts: int64(len(m.remotes))}
+		err := r.Store(pa, key, file)
+		m.setHealth(i, err)
+		if err != nil {
+			a.Debugf("storing %s to %s: %v", key, m.name(i), err)
+			errs.add(m.name(i), err)
+			continue
+		}
+		stored++
+	}
+	if stored < m.quorum() {
+		return fmt.Errorf("stored to %d of %d remotes, need %d: %v", stored, len(m.remotes), m.quorum(), errs.err())
+	}
+	return nil
+}
+
+// Retrieve retrieves the key from the first inner remote that succeeds, trying healthy remotes
+// before those that have failed recently.
+func (m *MirrorRemote) Retrieve(a Annex, key, file string) error {
+	var order []int
+	for i := range m.remotes {
+		if !m.failed(i) {
+			order = append(order, i)
+		}
+	}
+	for i := range m.remotes {
+		if m.failed(i) {
+			order = append(order, i)
+		}
+	}
+
+	var errs mirrorErrors
+	for _, i := range order {
+		err := m.remotes[i].Retrieve(m.annex(a, i), key, file)
+		m.setHealth(i, err)
+		if err == nil {
+			return nil
+		}
+		a.Debugf("retrieving %s from %s: %v", key, m.name(i), err)
+		errs.add(m.name(i), err)
+	}
+	return errs.err()
+}
+
+// Present checks whether at least Quorum inner remotes have the key.
+func (m *MirrorRemote) Present(a Annex, key string) (bool, error) {
+	var errs mirrorErrors
+	present := 0
+	for i, r := range m.remotes {
+		p, err := r.Present(m.annex(a, i), key)
+		m.setHealth(i, err)
+		switch {
+		case err != nil:
+			errs.add(m.name(i), err)
+		case p:
+			present++
+		}
+		if present >= m.quorum() {
+			return true, nil
+		}
+	}
+	// If the remotes that could not be checked might have made up the quorum, the answer is
+	// unknown rather than negative.
+	if present+len(errs) >= m.quorum() {
+		return false, errs.err()
+	}
+	return false, nil
+}
+
+// Remove removes the key from every inner remote.
+func (m *MirrorRemote) Remove(a Annex, key string) error {
+	var errs mirrorErrors
+	for i, r := range m.remotes {
+		err := r.Remove(m.annex(a, i), key)
+		m.setHealth(i, err)
+		if err != nil {
+			errs.add(m.name(i), err)
+		}
+	}
+	return errs.err()
+}
+
+// ListConfigs lists the settings of all inner remotes, omitting duplicates, followed by the
+// prefixed settings of the replicas.
+func (m *MirrorRemote) ListConfigs(a Annex) []ConfigSetting {
+	var configs, prefixed []ConfigSetting
+	seen := make(map[string]bool)
+	for i, r := range m.remotes {
+		var h HasListConfigs
+		if !As(r, &h) {
+			continue
+		}
+		for _, c := range h.ListConfigs(m.annex(a, i)) {
+			if !seen[c.Name] {
+				seen[c.Name] = true
+				configs = append(configs, c)
+			}
+			if i > 0 {
+				prefixed = append(prefixed, ConfigSetting{
+					Name:        m.name(i) + "-" + c.Name,
+					Description: fmt.Sprintf("%s: %s", m.name(i), c.Description),
+				})
+			}
+		}
+	}
+	return append(configs, prefixed...)
+}
+
+// GetInfo reports the quorum and the status of each inner remote.
+func (m *MirrorRemote) GetInfo(a Annex) []InfoField {
+	info := []InfoField{
+		{Name: "mirror quorum", Value: fmt.Sprintf("%d of %d", m.quorum(), len(m.remotes))},
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.remotes {
+		status := "ok"
+		if m.health[i].failed {
+			status = "failing: " + m.health[i].lastErr
+		}
+		info = append(info, InfoField{Name: m.name(i), Value: status})
+	}
+	return info
+}
+
+// replicaAnnex gives a replica its own namespace of config settings, creds, state, and UUID.
+type replicaAnnex struct {
+	stateNamespaceAnnex
+	prefix string
+}
+
+func (r *replicaAnnex) GetConfig(setting string) string {
+	if v := r.Annex.GetConfig(r.prefix + setting); v != "" {
+		return v
+	}
+	return r.Annex.GetConfig(setting)
+}
+
+func (r *replicaAnnex) SetConfig(setting, value string) {
+	r.Annex.SetConfig(r.prefix+setting, value)
+}
+
+func (r *replicaAnnex) GetCreds(setting string) (string, string) {
+	return r.Annex.GetCreds(r.prefix + setting)
+}
+
+func (r *replicaAnnex) SetCreds(setting, user, password string) {
+	r.Annex.SetCreds(r.prefix+setting, user, password)
+}
+
+func (r *replicaAnnex) GetUUID() string {
+	return r.Annex.GetUUID() + "-" + r.name
+}
+
+// mirrorProgressAnnex scales the progress of storing to one inner remote so that progress across
+// all of them is reported as a single pass over the file.
+type mirrorProgressAnnex struct {
+	Annex
+	base, parts int64
+}
+
+func (p *mirrorProgressAnnex) Progress(bytes int) {
+	p.Annex.Progress(int((p.base + int64(bytes)) / p.parts))
+}
+
+// Statically ensure that the combinator satisfies the interfaces used by the library.
+var (
+	_ RemoteV1       = (*MirrorRemote)(nil)
+	_ HasListConfigs = (*MirrorRemote)(nil)
+	_ HasGetInfo     = (*MirrorRemote)(nil)
+)
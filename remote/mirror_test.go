@@ -0,0 +1,115 @@
+package remote
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// stateRemote keeps content in memory and records, with plain SetState calls, which of its
+// objects holds each key, as remotes that name objects by something other than the key do.
+type stateRemote struct {
+	objects map[string][]byte
+	next    int
+}
+
+func newStateRemote() *stateRemote {
+	return &stateRemote{objects: make(map[string][]byte)}
+}
+
+func (r *stateRemote) Init(a Annex) error    { return nil }
+func (r *stateRemote) Prepare(a Annex) error { return nil }
+
+func (r *stateRemote) Store(a Annex, key, file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	r.next++
+	object := strconv.Itoa(r.next)
+	r.objects[object] = data
+	a.SetState(key, object)
+	return nil
+}
+
+func (r *stateRemote) Retrieve(a Annex, key, file string) error {
+	data, ok := r.objects[a.GetState(key)]
+	if !ok {
+		return errors.New("not stored")
+	}
+	return ioutil.WriteFile(file, data, 0o600)
+}
+
+func (r *stateRemote) Present(a Annex, key string) (bool, error) {
+	_, ok := r.objects[a.GetState(key)]
+	return ok, nil
+}
+
+func (r *stateRemote) Remove(a Annex, key string) error {
+	delete(r.objects, a.GetState(key))
+	a.SetState(key, "")
+	return nil
+}
+
+// progressTestAnnex discards progress in addition to keeping state.
+type progressTestAnnex struct {
+	*testAnnex
+}
+
+func (progressTestAnnex) Progress(bytes int) {}
+
+func TestMirrorState(t *testing.T) {
+	a := progressTestAnnex{newTestAnnex()}
+	primary, replica := newStateRemote(), newStateRemote()
+	// Start the replica's object names elsewhere, so that a lookup in the wrong namespace fails.
+	replica.next = 10
+	m := Mirror(primary, replica)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("content"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Store(a, "K", file); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, r := range []*stateRemote{primary, replica} {
+		if ok, err := r.Present(m.annex(a, i), "K"); err != nil || !ok {
+			t.Errorf("%s: Present = %v, %v", m.name(i), ok, err)
+		}
+		out := filepath.Join(dir, m.name(i))
+		if err := r.Retrieve(m.annex(a, i), "K", out); err != nil {
+			t.Errorf("%s: Retrieve: %v", m.name(i), err)
+		}
+	}
+	if ok, err := m.Present(a, "K"); err != nil || !ok {
+		t.Errorf("Present = %v, %v", ok, err)
+	}
+
+	if err := m.Remove(a, "K"); err != nil {
+		t.Fatal(err)
+	}
+	if len(primary.objects) != 0 || len(replica.objects) != 0 {
+		t.Errorf("Remove left objects %v and %v", primary.objects, replica.objects)
+	}
+	if ok, err := m.Present(a, "K"); err != nil || ok {
+		t.Errorf("Present after Remove = %v, %v", ok, err)
+	}
+}
+
+func TestMirrorLegacyPrimaryState(t *testing.T) {
+	a := progressTestAnnex{newTestAnnex()}
+	primary := newStateRemote()
+	primary.objects["x"] = []byte("content")
+	// State stored by the primary before it was mirrored.
+	a.SetState("K", "x")
+
+	m := Mirror(primary, newStateRemote())
+	m.Quorum = 1
+	if ok, err := m.Present(a, "K"); err != nil || !ok {
+		t.Errorf("Present = %v, %v", ok, err)
+	}
+}
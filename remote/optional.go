@@ -1,6 +1,7 @@
 package remote
 
 import (
+	"errors"
 	"strconv"
 	"strings"
 )
@@ -12,8 +13,8 @@ type HasExtensions interface {
 }
 
 func (a *annexIO) extensions(e []string) {
-	h, ok := a.impl.(HasExtensions)
-	if !ok {
+	var h HasExtensions
+	if !As(a.impl, &h) {
 		a.unsupported()
 		return
 	}
@@ -34,12 +35,22 @@ type HasListConfigs interface {
 }
 
 func (a *annexIO) listConfigs() {
-	h, ok := a.impl.(HasListConfigs)
-	if !ok {
+	var h HasListConfigs
+	if !As(a.impl, &h) {
 		a.unsupported()
 		return
 	}
-	for _, c := range h.ListConfigs(a) {
+	configs := h.ListConfigs(a)
+	names := make(map[string]bool)
+	for _, c := range configs {
+		names[c.Name] = true
+	}
+	for _, c := range guardConfigs {
+		if !names[c.Name] {
+			configs = append(configs, c)
+		}
+	}
+	for _, c := range configs {
 		a.send("CONFIG", c.Name, c.Description)
 	}
 	a.send("CONFIGEND")
@@ -52,8 +63,8 @@ type HasGetCost interface {
 }
 
 func (a *annexIO) getCost() {
-	h, ok := a.impl.(HasGetCost)
-	if !ok {
+	var h HasGetCost
+	if !As(a.impl, &h) {
 		a.unsupported()
 		return
 	}
@@ -67,8 +78,8 @@ type HasGetAvailability interface {
 }
 
 func (a *annexIO) getAvailability() {
-	h, ok := a.impl.(HasGetAvailability)
-	if !ok {
+	var h HasGetAvailability
+	if !As(a.impl, &h) {
 		a.unsupported()
 		return
 	}
@@ -82,8 +93,8 @@ type HasClaimURL interface {
 }
 
 func (a *annexIO) claimURL(url string) {
-	h, ok := a.impl.(HasClaimURL)
-	if !ok {
+	var h HasClaimURL
+	if !As(a.impl, &h) {
 		a.unsupported()
 		return
 	}
@@ -109,8 +120,8 @@ type HasCheckURL interface {
 }
 
 func (a *annexIO) checkURL(url string) {
-	h, ok := a.impl.(HasCheckURL)
-	if !ok {
+	var h HasCheckURL
+	if !As(a.impl, &h) {
 		a.unsupported()
 		return
 	}
@@ -156,8 +167,8 @@ type HasWhereIs interface {
 }
 
 func (a *annexIO) whereIs(key string) {
-	h, ok := a.impl.(HasWhereIs)
-	if !ok {
+	var h HasWhereIs
+	if !As(a.impl, &h) {
 		a.unsupported()
 		return
 	}
@@ -182,8 +193,8 @@ type HasGetInfo interface {
 }
 
 func (a *annexIO) getInfo() {
-	h, ok := a.impl.(HasGetInfo)
-	if !ok {
+	var h HasGetInfo
+	if !As(a.impl, &h) {
 		a.unsupported()
 		return
 	}
@@ -208,7 +219,7 @@ type HasExport interface {
 }
 
 func (a *annexIO) exportSupported() {
-	if _, ok := a.impl.(HasExport); !ok {
+	if !As(a.impl, new(HasExport)) {
 		a.sendFailure(cmdExportSupported)
 		return
 	}
@@ -220,8 +231,8 @@ func (a *annexIO) export(name string) {
 }
 
 func (a *annexIO) presentExport(key string) {
-	h, ok := a.impl.(HasExport)
-	if !ok {
+	var h HasExport
+	if !As(a.impl, &h) {
 		a.unsupported()
 		return
 	}
@@ -236,8 +247,8 @@ func (a *annexIO) presentExport(key string) {
 }
 
 func (a *annexIO) transferExport(dir, key, file string) {
-	h, ok := a.impl.(HasExport)
-	if !ok {
+	var h HasExport
+	if !As(a.impl, &h) {
 		a.unsupported()
 		return
 	}
@@ -246,6 +257,10 @@ func (a *annexIO) transferExport(dir, key, file string) {
 	case dirRetrieve:
 		proc = h.RetrieveExport
 	case dirStore:
+		if err := a.guard("export %s to %s", key, a.exportName); err != nil {
+			a.sendFailure(cmdTransfer, dir, key, err)
+			return
+		}
 		proc = h.StoreExport
 	default:
 		panic("unknown transfer direction " + dir)
@@ -258,11 +273,15 @@ func (a *annexIO) transferExport(dir, key, file string) {
 }
 
 func (a *annexIO) removeExport(key string) {
-	h, ok := a.impl.(HasExport)
-	if !ok {
+	var h HasExport
+	if !As(a.impl, &h) {
 		a.unsupported()
 		return
 	}
+	if err := a.guard("remove exported %s", a.exportName); err != nil {
+		a.sendFailure(cmdRemove, key, err)
+		return
+	}
 	if err := h.RemoveExport(a, a.exportName, key); err != nil {
 		a.sendFailure(cmdRemove, key, err)
 		return
@@ -277,11 +296,19 @@ type HasRemoveExportDirectory interface {
 }
 
 func (a *annexIO) removeExportDirectory(directory string) {
-	h, ok := a.impl.(HasRemoveExportDirectory)
-	if !ok {
+	var h HasRemoveExportDirectory
+	if !As(a.impl, &h) {
 		a.unsupported()
 		return
 	}
+	if err := a.guard("remove exported directory %s", directory); err != nil {
+		// The failure response carries no message, so report refusals separately.
+		if errors.Is(err, ErrReadOnly) {
+			a.Info(err.Error())
+		}
+		a.sendFailure(cmdRemoveExportDirectory)
+		return
+	}
 	if err := h.RemoveExportDirectory(a, directory); err != nil {
 		a.sendFailure(cmdRemoveExportDirectory)
 		return
@@ -296,11 +323,18 @@ type HasRenameExport interface {
 }
 
 func (a *annexIO) renameExport(name, key, newName string) {
-	h, ok := a.impl.(HasRenameExport)
-	if !ok {
+	var h HasRenameExport
+	if !As(a.impl, &h) {
 		a.unsupported()
 		return
 	}
+	if err := a.guard("rename exported %s to %s", name, newName); err != nil {
+		if errors.Is(err, ErrReadOnly) {
+			a.Info(err.Error())
+		}
+		a.sendFailure(cmdRenameExport, key)
+		return
+	}
 	if err := h.RenameExport(a, name, key, newName); err != nil {
 		a.sendFailure(cmdRenameExport, key)
 		return
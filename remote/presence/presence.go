@@ -0,0 +1,294 @@
+// Package presence provides a wrapper for external special remotes that keeps a local index of
+// the keys stored in the remote, so that CHECKPRESENT can often be answered without contacting
+// slow storage. This matters for commands like `git annex fsck` and `git annex sync --content`,
+// which check the presence of many keys.
+//
+// The index is an append-only log kept under the git directory of the repository using the remote,
+// so it reflects only the operations performed from that repository (plus the results of earlier
+// presence checks). It is updated whenever the wrapped remote successfully stores, retrieves, or
+// removes a key or answers a presence check. Since other clones may store keys in the remote
+// without this repository knowing, a key recorded as absent is only trusted as such when the index
+// is authoritative or for the TTL; a key recorded as present is trusted until the TTL expires.
+//
+// Several git-annex processes may use the same index at once. Appending to the log and compacting
+// it are serialized with a lock on a file next to the log, except on systems without file locks
+// (Windows and Plan 9), where an entry appended during a compaction may be lost.
+package presence
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dzhu/go-git-annex-external/remote"
+)
+
+// Options controls how the index is consulted.
+type Options struct {
+	// TTL is how long an entry in the index is trusted before Present asks the wrapped remote
+	// again. Zero means that entries recording a key as present never expire and that entries
+	// recording it as absent are not trusted at all, unless the index is authoritative.
+	TTL time.Duration
+	// Authoritative makes Present answer only from the index, never contacting the wrapped remote.
+	// Keys absent from the index are reported as not present. This is only appropriate when all
+	// changes to the remote are made from this repository.
+	Authoritative bool
+	// Dir is the directory in which the index is kept. If empty, a directory inside the git
+	// directory reported by git-annex is used.
+	Dir string
+}
+
+// Remote wraps a remote with a local presence index.
+type Remote struct {
+	remote.RemoteV1
+	opts Options
+
+	mu       sync.Mutex
+	path     string
+	lockPath string
+	entries  map[string]entry
+	logged   int
+}
+
+type entry struct {
+	present bool
+	checked time.Time
+}
+
+// Wrap returns a remote that behaves like r but maintains a presence index as described in the
+// package documentation.
+func Wrap(r remote.RemoteV1, opts Options) *Remote {
+	return &Remote{RemoteV1: r, opts: opts}
+}
+
+// Unwrap returns the wrapped remote.
+func (r *Remote) Unwrap() remote.RemoteV1 {
+	return r.RemoteV1
+}
+
+// Prepare prepares the wrapped remote and loads the index.
+func (r *Remote) Prepare(a remote.Annex) error {
+	if err := r.RemoteV1.Prepare(a); err != nil {
+		return err
+	}
+	dir := r.opts.Dir
+	if dir == "" {
+		dir = filepath.Join(a.GetGitDir(), "annex", "external-presence")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.path = filepath.Join(dir, a.GetUUID()+".log")
+	r.lockPath = filepath.Join(dir, a.GetUUID()+".lock")
+	unlock, err := lockFile(r.lockPath, false)
+	if err != nil {
+		return fmt.Errorf("locking presence index: %w", err)
+	}
+	err = r.load()
+	unlock()
+	if err != nil {
+		return fmt.Errorf("loading presence index: %w", err)
+	}
+	a.Debugf("loaded presence index %s with %d entries", r.path, len(r.entries))
+	if r.logged > 2*len(r.entries)+1000 {
+		if err := r.compact(); err != nil {
+			a.Debugf("compacting presence index: %v", err)
+		}
+	}
+	return nil
+}
+
+// Store stores the key with the wrapped remote and records it as present.
+func (r *Remote) Store(a remote.Annex, key, file string) error {
+	if err := r.RemoteV1.Store(a, key, file); err != nil {
+		return err
+	}
+	r.record(a, key, true)
+	return nil
+}
+
+// Retrieve retrieves the key from the wrapped remote and records it as present.
+func (r *Remote) Retrieve(a remote.Annex, key, file string) error {
+	if err := r.RemoteV1.Retrieve(a, key, file); err != nil {
+		return err
+	}
+	r.record(a, key, true)
+	return nil
+}
+
+// Present answers from the index if possible and otherwise asks the wrapped remote.
+func (r *Remote) Present(a remote.Annex, key string) (bool, error) {
+	r.mu.Lock()
+	e, ok := r.entries[key]
+	r.mu.Unlock()
+
+	switch {
+	case ok && r.opts.Authoritative:
+		return e.present, nil
+	case r.opts.Authoritative:
+		return false, nil
+	case ok && r.opts.TTL > 0 && time.Since(e.checked) < r.opts.TTL:
+		return e.present, nil
+	case ok && r.opts.TTL == 0 && e.present:
+		return true, nil
+	}
+
+	present, err := r.RemoteV1.Present(a, key)
+	if err != nil {
+		return false, err
+	}
+	r.record(a, key, present)
+	return present, nil
+}
+
+// Remove removes the key from the wrapped remote and records it as absent.
+func (r *Remote) Remove(a remote.Annex, key string) error {
+	if err := r.RemoteV1.Remove(a, key); err != nil {
+		return err
+	}
+	r.record(a, key, false)
+	return nil
+}
+
+// Forget drops any entry for the key from the index, so that the next presence check consults the
+// wrapped remote.
+func (r *Remote) Forget(a remote.Annex, key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, key)
+	if err := r.appendLine(fmt.Sprintf("%s - %d", key, time.Now().Unix())); err != nil {
+		a.Debugf("updating presence index: %v", err)
+	}
+}
+
+func (r *Remote) record(a remote.Annex, key string, present bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.entries == nil {
+		r.entries = make(map[string]entry)
+	}
+	e := entry{present, time.Now()}
+	r.entries[key] = e
+	if err := r.appendLine(formatEntry(key, e)); err != nil {
+		// The index is only an optimization, so failing to update it should not fail the operation.
+		a.Debugf("updating presence index: %v", err)
+	}
+}
+
+// Each line of the log has the form "<key> <state> <unix time>", where state is "1" for present,
+// "0" for absent, and "-" for forgotten. Later lines override earlier ones.
+
+func formatEntry(key string, e entry) string {
+	state := "0"
+	if e.present {
+		state = "1"
+	}
+	return fmt.Sprintf("%s %s %d", key, state, e.checked.Unix())
+}
+
+func (r *Remote) load() error {
+	r.entries = make(map[string]entry)
+	r.logged = 0
+
+	f, err := os.Open(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 3 {
+			// Probably a line cut short by a crash; skip it.
+			continue
+		}
+		ts, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		r.logged++
+		switch fields[1] {
+		case "1", "0":
+			r.entries[fields[0]] = entry{fields[1] == "1", time.Unix(ts, 0)}
+		case "-":
+			delete(r.entries, fields[0])
+		}
+	}
+	return s.Err()
+}
+
+func (r *Remote) appendLine(line string) error {
+	if r.path == "" {
+		return nil
+	}
+	// Appends only need to exclude compaction, which would otherwise rename the log away from
+	// under them, and not each other, since appends of single lines are atomic.
+	unlock, err := lockFile(r.lockPath, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		f.Close()
+		return err
+	}
+	r.logged++
+	return f.Close()
+}
+
+// compact rewrites the log so that it contains only one line per key. It reads the log again once
+// it holds the lock, so that entries appended by other processes since it was loaded are kept.
+func (r *Remote) compact() error {
+	unlock, err := lockFile(r.lockPath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := r.load(); err != nil {
+		return err
+	}
+
+	tmp := r.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for key, e := range r.entries {
+		fmt.Fprintln(w, formatEntry(key, e))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return err
+	}
+	r.logged = len(r.entries)
+	return nil
+}
+
+// Statically ensure that the wrapper satisfies the interfaces used by the library.
+var (
+	_ remote.RemoteV1  = (*Remote)(nil)
+	_ remote.Unwrapper = (*Remote)(nil)
+)
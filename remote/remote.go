@@ -6,6 +6,10 @@
 // of it to the Run function. Optional messages in the protocol may be supported by having the type
 // additionally implement the "Has*" interfaces.
 //
+// Behavior such as caching or chunking can be layered onto an implementation by wrapping it in
+// another RemoteV1 that implements Unwrapper; the subpackages of this package provide several such
+// wrappers.
+//
 // See https://git-annex.branchable.com/design/external_special_remote_protocol/ for further
 // information regarding the underlying protocol and the semantics of its operations.
 package remote
@@ -112,6 +116,10 @@ func (a *annexIO) initialize() {
 }
 
 func (a *annexIO) prepare() {
+	if err := a.mode.load(a); err != nil {
+		a.sendFailure(cmdPrepare, err)
+		return
+	}
 	if err := a.impl.Prepare(a); err != nil {
 		a.sendFailure(cmdPrepare, err)
 		return
@@ -125,6 +133,10 @@ func (a *annexIO) transfer(dir, key, file string) {
 	case dirRetrieve:
 		proc = a.impl.Retrieve
 	case dirStore:
+		if err := a.guard("store %s", key); err != nil {
+			a.sendFailure(cmdTransfer, dir, key, err)
+			return
+		}
 		proc = a.impl.Store
 	default:
 		panic("unknown transfer direction " + dir)
@@ -148,6 +160,10 @@ func (a *annexIO) present(key string) {
 }
 
 func (a *annexIO) remove(key string) {
+	if err := a.guard("remove %s", key); err != nil {
+		a.sendFailure(cmdRemove, key, err)
+		return
+	}
 	if err := a.impl.Remove(a, key); err != nil {
 		a.sendFailure(cmdRemove, key, err)
 		return
@@ -158,8 +174,9 @@ func (a *annexIO) remove(key string) {
 // Run executes an external special remote as git-annex expects, reading from stdin and writing to
 // stdout.
 func Run(r RemoteV1) {
+	mode := &modeState{}
 	internal.Run(func(lines internal.LineIO) map[string]internal.CommandSpec {
-		a := &annexIO{io: lines, impl: r}
+		a := &annexIO{io: lines, impl: r, mode: mode}
 
 		return map[string]internal.CommandSpec{
 			internal.StartupCmd:      internal.Response0(a.startup),
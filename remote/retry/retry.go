@@ -0,0 +1,201 @@
+// Package retry provides a wrapper for external special remotes that retries failed operations with
+// exponential backoff, so that transient errors such as dropped connections or throttling do not
+// immediately surface to git-annex as failures.
+//
+// Store, Retrieve, Present, and Remove are retried. An error is retried unless it is permanent:
+// errors wrapped with Permanent are always permanent, and the wrapped remote (or any remote it
+// wraps) may implement Classifier to classify other errors. The number of attempts and the delays
+// between them are controlled by the "retries", "retrydelay", and "retrymaxdelay" config settings.
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/dzhu/go-git-annex-external/remote"
+)
+
+// PermanentError wraps an error that should not be retried.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent marks an error as permanent, so that the operation returning it is not retried. It
+// returns nil if err is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{err}
+}
+
+// Classifier may be implemented by a remote to indicate which of its errors are permanent.
+type Classifier interface {
+	IsPermanent(err error) bool
+}
+
+// Config is the configuration read by the wrapper.
+type Config struct {
+	Retries  int           `config:"retries" default:"3" desc:"number of times to retry a failed operation"`
+	Delay    time.Duration `config:"retrydelay" default:"1s" desc:"delay before the first retry"`
+	MaxDelay time.Duration `config:"retrymaxdelay" default:"1m" desc:"maximum delay between retries"`
+}
+
+// Validate checks that the settings are in range.
+func (c *Config) Validate() error {
+	switch {
+	case c.Retries < 0:
+		return errors.New("retries must not be negative")
+	case c.Delay < 0 || c.MaxDelay < 0:
+		return errors.New("retry delays must not be negative")
+	}
+	return nil
+}
+
+// Remote wraps a remote to retry its operations.
+type Remote struct {
+	remote.RemoteV1
+	Config
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// Wrap returns a remote that retries failed operations of r.
+func Wrap(r remote.RemoteV1) *Remote {
+	return &Remote{
+		RemoteV1: r,
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Unwrap returns the wrapped remote.
+func (r *Remote) Unwrap() remote.RemoteV1 {
+	return r.RemoteV1
+}
+
+// ListConfigs returns the settings of the wrapper followed by those of the wrapped remote.
+func (r *Remote) ListConfigs(a remote.Annex) []remote.ConfigSetting {
+	configs := remote.NewConfig(&Config{}).ListConfigs()
+	var h remote.HasListConfigs
+	if remote.As(r.RemoteV1, &h) {
+		configs = append(configs, h.ListConfigs(a)...)
+	}
+	return configs
+}
+
+// Init validates the settings and initializes the wrapped remote.
+func (r *Remote) Init(a remote.Annex) error {
+	if err := remote.NewConfig(&r.Config).Load(a); err != nil {
+		return err
+	}
+	return r.RemoteV1.Init(a)
+}
+
+// Prepare loads the settings and prepares the wrapped remote.
+func (r *Remote) Prepare(a remote.Annex) error {
+	if err := remote.NewConfig(&r.Config).Load(a); err != nil {
+		return err
+	}
+	return r.RemoteV1.Prepare(a)
+}
+
+func (r *Remote) permanent(err error) bool {
+	var p *PermanentError
+	if errors.As(err, &p) {
+		return true
+	}
+	var c Classifier
+	return remote.As(r.RemoteV1, &c) && c.IsPermanent(err)
+}
+
+// backoff returns the delay before the given retry (numbered from 1): the base delay doubled for
+// each earlier retry, capped at the maximum, with up to half of it randomly removed so that
+// concurrent jobs do not retry in lockstep.
+func (r *Remote) backoff(retry int) time.Duration {
+	d := r.Delay
+	for i := 1; i < retry && d < r.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > r.MaxDelay {
+		d = r.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return d/2 + time.Duration(r.rnd.Int63n(int64(d/2)+1))
+}
+
+func (r *Remote) do(a remote.Annex, op string, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		switch {
+		case err == nil:
+			return nil
+		case r.permanent(err):
+			a.Debugf("%s failed permanently on attempt %d: %v", op, attempt, err)
+			return err
+		case attempt > r.Retries:
+			a.Debugf("%s failed on attempt %d, giving up: %v", op, attempt, err)
+			if attempt > 1 {
+				return fmt.Errorf("%w (after %d attempts)", err, attempt)
+			}
+			return err
+		}
+		d := r.backoff(attempt)
+		a.Debugf("%s failed on attempt %d, retrying in %v: %v", op, attempt, d, err)
+		time.Sleep(d)
+	}
+}
+
+// Store stores the key with the wrapped remote, retrying on failure.
+func (r *Remote) Store(a remote.Annex, key, file string) error {
+	return r.do(a, "store "+key, func() error {
+		return r.RemoteV1.Store(a, key, file)
+	})
+}
+
+// Retrieve retrieves the key from the wrapped remote, retrying on failure.
+func (r *Remote) Retrieve(a remote.Annex, key, file string) error {
+	return r.do(a, "retrieve "+key, func() error {
+		return r.RemoteV1.Retrieve(a, key, file)
+	})
+}
+
+// Present checks for the key with the wrapped remote, retrying if the check fails.
+func (r *Remote) Present(a remote.Annex, key string) (bool, error) {
+	var present bool
+	err := r.do(a, "check presence of "+key, func() error {
+		var err error
+		present, err = r.RemoteV1.Present(a, key)
+		return err
+	})
+	return present, err
+}
+
+// Remove removes the key from the wrapped remote, retrying on failure.
+func (r *Remote) Remove(a remote.Annex, key string) error {
+	return r.do(a, "remove "+key, func() error {
+		return r.RemoteV1.Remove(a, key)
+	})
+}
+
+// Statically ensure that the wrapper satisfies the interfaces used by the library.
+var (
+	_ remote.RemoteV1       = (*Remote)(nil)
+	_ remote.Unwrapper      = (*Remote)(nil)
+	_ remote.HasListConfigs = (*Remote)(nil)
+)
@@ -0,0 +1,219 @@
+package remote
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// MaxStateLen is the maximum length of an encoded value accepted by State.Set. git-annex stores
+// each state value in the git-annex branch and passes it back on a single protocol line, so
+// values are kept well short of anything that would make that unwieldy.
+const MaxStateLen = 32 << 10
+
+// ErrStateTooLarge is returned (wrapped in a *StateError) when an encoded value exceeds
+// MaxStateLen.
+var ErrStateTooLarge = errors.New("encoded state is too large")
+
+// StateError describes a state value that could not be stored or loaded.
+type StateError struct {
+	Setting string
+	Err     error
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("state %s: %v", e.Setting, e.Err)
+}
+
+func (e *StateError) Unwrap() error {
+	return e.Err
+}
+
+// State stores structured values in the per-key state that git-annex keeps for the remote, as
+// accessed with SETSTATE and GETSTATE. Values are encoded as JSON along with a schema version, and
+// the result is base64-encoded so that it never contains spaces or newlines.
+//
+// git-annex keeps only one state value per key for each remote. So that several wrappers and
+// combinators can keep state for the same key, each State has a Name, and the value stored in
+// git-annex holds the values of all names.
+type State struct {
+	// Name distinguishes the values of this State from those stored by other States for the same
+	// keys. Each wrapper or combinator should use its own name.
+	Name string
+	// Version is the current schema version. Values are always stored with this version.
+	Version int
+	// Migrations converts the JSON encoding of a value stored with schema version n (the map key)
+	// to the encoding for version n+1. When a value with an older version is loaded, each
+	// migration from its version up to Version is applied in turn.
+	Migrations map[int]func(data json.RawMessage) (json.RawMessage, error)
+}
+
+type stateEnvelope struct {
+	Version int             `json:"v"`
+	Data    json.RawMessage `json:"d"`
+}
+
+// Set encodes v as JSON and stores it as the state for the given setting (typically a key).
+func (s *State) Set(a Annex, setting string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return &StateError{setting, err}
+	}
+	env, err := json.Marshal(stateEnvelope{Version: s.Version, Data: data})
+	if err != nil {
+		return &StateError{setting, err}
+	}
+	enc := base64.RawURLEncoding.EncodeToString(env)
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if err := setStateEntry(a, setting, s.Name, enc); err != nil {
+		return &StateError{setting, err}
+	}
+	return nil
+}
+
+// Get loads the state for the given setting into v, migrating it to the current schema version if
+// necessary. It reports whether any state was present; if none was, v is left unchanged.
+func (s *State) Get(a Annex, setting string, v interface{}) (bool, error) {
+	stateMu.Lock()
+	enc, err := getStateEntry(a, setting, s.Name)
+	stateMu.Unlock()
+	if err != nil {
+		return false, &StateError{setting, err}
+	}
+	if enc == "" {
+		return false, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return false, &StateError{setting, err}
+	}
+	var env stateEnvelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return false, &StateError{setting, err}
+	}
+	if env.Version > s.Version {
+		return false, &StateError{
+			setting, fmt.Errorf("stored version %d is newer than supported version %d", env.Version, s.Version),
+		}
+	}
+	for ver := env.Version; ver < s.Version; ver++ {
+		migrate, ok := s.Migrations[ver]
+		if !ok {
+			return false, &StateError{setting, fmt.Errorf("no migration from version %d", ver)}
+		}
+		if env.Data, err = migrate(env.Data); err != nil {
+			return false, &StateError{setting, fmt.Errorf("migrating from version %d: %w", ver, err)}
+		}
+	}
+	if err := json.Unmarshal(env.Data, v); err != nil {
+		return false, &StateError{setting, err}
+	}
+	return true, nil
+}
+
+// Clear removes the state for the given setting.
+func (s *State) Clear(a Annex, setting string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if err := setStateEntry(a, setting, s.Name, ""); err != nil {
+		a.Debugf("clearing state %s: %v", setting, err)
+	}
+}
+
+// stateMapPrefix begins a per-key state value holding the values of several names. The rest of
+// the value is the base64 encoding of a JSON object mapping each name to its value. Any other
+// non-empty value, as stored before names were introduced, is the value of the empty name. It is
+// kept when other names are set, and it is read by names that have no entry of their own; a name
+// that is cleared while it exists keeps an empty entry so that the value does not reappear.
+const stateMapPrefix = "~"
+
+// stateMu serializes the reading and rewriting of per-key state values by State, so that
+// concurrent jobs setting the values of different names for the same key do not lose each other's
+// updates. It is held for the whole of each State method, including any calls through nested
+// stateNamespaceAnnex values, which therefore do not take it themselves.
+var stateMu sync.Mutex
+
+func decodeStateMap(value string) (map[string]string, error) {
+	m := make(map[string]string)
+	switch {
+	case value == "":
+	case strings.HasPrefix(value, stateMapPrefix):
+		raw, err := base64.RawURLEncoding.DecodeString(value[len(stateMapPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return nil, err
+		}
+	default:
+		m[""] = value
+	}
+	return m, nil
+}
+
+// getStateEntry returns the value stored under the name in the state for the setting.
+func getStateEntry(a Annex, setting, name string) (string, error) {
+	m, err := decodeStateMap(a.GetState(setting))
+	if err != nil {
+		return "", err
+	}
+	if value, ok := m[name]; ok {
+		return value, nil
+	}
+	return m[""], nil
+}
+
+// setStateEntry stores the value under the name in the state for the setting, keeping the values of
+// other names. An empty value removes the name.
+func setStateEntry(a Annex, setting, name, value string) error {
+	m, err := decodeStateMap(a.GetState(setting))
+	if err != nil {
+		return err
+	}
+	switch {
+	case value != "":
+		m[name] = value
+	case name != "" && m[""] != "":
+		m[name] = ""
+	default:
+		delete(m, name)
+	}
+	enc := ""
+	if len(m) > 0 {
+		raw, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		enc = stateMapPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	}
+	if len(enc) > MaxStateLen {
+		return ErrStateTooLarge
+	}
+	a.SetState(setting, enc)
+	return nil
+}
+
+// stateNamespaceAnnex gives an inner remote of a combinator its own namespace within the per-key
+// state, so that inner remotes using the same State names do not overwrite each other's values.
+type stateNamespaceAnnex struct {
+	Annex
+	name string
+}
+
+func (s stateNamespaceAnnex) GetState(setting string) string {
+	value, err := getStateEntry(s.Annex, setting, s.name)
+	if err != nil {
+		s.Annex.Debugf("reading state %s of %s: %v", setting, s.name, err)
+	}
+	return value
+}
+
+func (s stateNamespaceAnnex) SetState(setting, value string) {
+	if err := setStateEntry(s.Annex, setting, s.name, value); err != nil {
+		s.Annex.Debugf("setting state %s of %s: %v", setting, s.name, err)
+	}
+}
@@ -0,0 +1,205 @@
+package remote
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testAnnex keeps per-key state in memory. Its other methods are those of the nil Annex, so tests
+// using it must not call them, except for the messages, which are discarded.
+type testAnnex struct {
+	Annex
+	mu    sync.Mutex
+	state map[string]string
+}
+
+func newTestAnnex() *testAnnex {
+	return &testAnnex{state: make(map[string]string)}
+}
+
+func (a *testAnnex) GetState(setting string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.state[setting]
+}
+
+func (a *testAnnex) SetState(setting, value string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if value == "" {
+		delete(a.state, setting)
+	} else {
+		a.state[setting] = value
+	}
+}
+
+func (a *testAnnex) Debugf(fmt string, args ...interface{}) {}
+
+func TestStateSetGet(t *testing.T) {
+	a := newTestAnnex()
+	s := &State{Name: "test", Version: 1}
+	type value struct{ N int }
+
+	var v value
+	if ok, err := s.Get(a, "K", &v); ok || err != nil {
+		t.Fatalf("Get before Set = %v, %v", ok, err)
+	}
+	if err := s.Set(a, "K", value{42}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.ContainsAny(a.state["K"], " \n") {
+		t.Errorf("stored value %q contains spaces or newlines", a.state["K"])
+	}
+	if ok, err := s.Get(a, "K", &v); !ok || err != nil || v.N != 42 {
+		t.Fatalf("Get = %v, %v, %+v", ok, err, v)
+	}
+	s.Clear(a, "K")
+	if ok, err := s.Get(a, "K", &v); ok || err != nil {
+		t.Errorf("Get after Clear = %v, %v", ok, err)
+	}
+	if _, ok := a.state["K"]; ok {
+		t.Errorf("Clear left %q", a.state["K"])
+	}
+}
+
+func TestStateNames(t *testing.T) {
+	a := newTestAnnex()
+	s1, s2 := &State{Name: "one", Version: 1}, &State{Name: "two", Version: 1}
+	if err := s1.Set(a, "K", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Set(a, "K", 2); err != nil {
+		t.Fatal(err)
+	}
+	var v1, v2 int
+	if _, err := s1.Get(a, "K", &v1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s2.Get(a, "K", &v2); err != nil {
+		t.Fatal(err)
+	}
+	if v1 != 1 || v2 != 2 {
+		t.Errorf("got %d and %d, want 1 and 2", v1, v2)
+	}
+	s1.Clear(a, "K")
+	if ok, _ := s2.Get(a, "K", &v2); !ok || v2 != 2 {
+		t.Errorf("clearing one name cleared the other")
+	}
+}
+
+func TestStateLegacyValue(t *testing.T) {
+	a := newTestAnnex()
+	// A value stored before States had names: the bare envelope {"v":1,"d":7}.
+	legacy := "eyJ2IjoxLCJkIjo3fQ"
+	a.state["K"] = legacy
+	s1, s2 := &State{Name: "one", Version: 1}, &State{Name: "two", Version: 1}
+
+	var v int
+	if ok, err := s1.Get(a, "K", &v); !ok || err != nil || v != 7 {
+		t.Fatalf("Get of legacy value = %v, %v, %d", ok, err, v)
+	}
+	if err := s2.Set(a, "K", 2); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s1.Get(a, "K", &v); !ok || v != 7 {
+		t.Errorf("setting another name lost the legacy value")
+	}
+	if got, _ := getStateEntry(a, "K", ""); got != legacy {
+		t.Errorf("legacy entry = %q, want %q", got, legacy)
+	}
+	s1.Clear(a, "K")
+	if ok, _ := s1.Get(a, "K", &v); ok {
+		t.Errorf("legacy value reappeared after Clear")
+	}
+}
+
+func TestStateNamespaceAnnex(t *testing.T) {
+	a := newTestAnnex()
+	s := &State{Name: "chunk", Version: 1}
+	hot, cold := stateNamespaceAnnex{a, "hot"}, stateNamespaceAnnex{a, "cold"}
+	if err := s.Set(hot, "K", "h"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(cold, "K", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(a, "K", "outer"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		a    Annex
+		want string
+	}{{hot, "h"}, {cold, "c"}, {a, "outer"}} {
+		var v string
+		if _, err := s.Get(tc.a, "K", &v); err != nil || v != tc.want {
+			t.Errorf("Get = %q, %v, want %q", v, err, tc.want)
+		}
+	}
+}
+
+func TestStateMigrations(t *testing.T) {
+	a := newTestAnnex()
+	if err := (&State{Name: "m", Version: 1}).Set(a, "K", map[string]int{"n": 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Version 2 renames the field, and version 3 doubles it.
+	migrations := map[int]func(json.RawMessage) (json.RawMessage, error){
+		1: func(data json.RawMessage) (json.RawMessage, error) {
+			var v1 struct{ N int }
+			if err := json.Unmarshal(data, &v1); err != nil {
+				return nil, err
+			}
+			return json.Marshal(map[string]int{"count": v1.N})
+		},
+		2: func(data json.RawMessage) (json.RawMessage, error) {
+			var v2 struct{ Count int }
+			if err := json.Unmarshal(data, &v2); err != nil {
+				return nil, err
+			}
+			return json.Marshal(map[string]int{"count": v2.Count * 2})
+		},
+	}
+	s3 := &State{Name: "m", Version: 3, Migrations: migrations}
+	var v3 struct{ Count int }
+	if ok, err := s3.Get(a, "K", &v3); !ok || err != nil || v3.Count != 6 {
+		t.Fatalf("Get = %v, %v, %+v, want count 6", ok, err, v3)
+	}
+
+	// A gap in the chain is an error.
+	gap := &State{Name: "m", Version: 3, Migrations: map[int]func(json.RawMessage) (json.RawMessage, error){
+		2: migrations[2],
+	}}
+	if _, err := gap.Get(a, "K", &v3); err == nil {
+		t.Error("Get with a missing migration succeeded")
+	}
+
+	// A failing migration is reported.
+	failure := errors.New("failed")
+	failing := &State{Name: "m", Version: 2, Migrations: map[int]func(json.RawMessage) (json.RawMessage, error){
+		1: func(json.RawMessage) (json.RawMessage, error) { return nil, failure },
+	}}
+	if _, err := failing.Get(a, "K", &v3); !errors.Is(err, failure) {
+		t.Errorf("Get with a failing migration = %v, want %v", err, failure)
+	}
+
+	// Values from newer versions are refused rather than misread.
+	if err := s3.Set(a, "K", v3); err != nil {
+		t.Fatal(err)
+	}
+	var se *StateError
+	if _, err := (&State{Name: "m", Version: 2}).Get(a, "K", &v3); !errors.As(err, &se) {
+		t.Errorf("Get of a newer version = %v, want a *StateError", err)
+	}
+}
+
+func TestStateTooLarge(t *testing.T) {
+	a := newTestAnnex()
+	err := (&State{Name: "big", Version: 1}).Set(a, "K", strings.Repeat("x", MaxStateLen))
+	if !errors.Is(err, ErrStateTooLarge) {
+		t.Errorf("Set = %v, want %v", err, ErrStateTooLarge)
+	}
+}
@@ -0,0 +1,376 @@
+package remote
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TieredConfig is the configuration read by a TieredRemote.
+type TieredConfig struct {
+	MaxAge  time.Duration `config:"hotmaxage" desc:"move content to the cold tier once it has been in the hot tier this long, such as 720h (0 to disable)"`
+	MaxSize Size          `config:"hotmaxsize" desc:"store content larger than this directly in the cold tier, such as 1GiB (0 for no limit)"`
+	Promote bool          `config:"promote" desc:"copy content retrieved from the cold tier back into the hot tier (yes or no)"`
+}
+
+// TieredRemote is a remote that keeps content in a fast "hot" inner remote and moves it to a slow
+// "cold" inner remote according to its age and size. Create one with Tiered.
+//
+// Store writes to the hot tier, unless the content exceeds the hotmaxsize setting, in which case it
+// goes directly to the cold tier. The tiers holding each key and the time it entered the hot tier
+// are recorded in the remote's state. Retrieve reads from whichever tier holds the key, preferring
+// the hot tier, and with promote=yes copies content read from the cold tier back into the hot tier.
+//
+// Content that has been in the hot tier for longer than the hotmaxage setting is moved to the cold
+// tier by Prepare, which sweeps the keys that were put in the hot tier through the same repository;
+// these are listed in a directory under .git/annex/tiered. Content put in the hot tier through other
+// clones of the repository is only moved when Migrate is called for it. Other operations never move
+// content between the tiers.
+//
+// Each tier is given its own namespace within the remote's state, so the tiers may be wrapped by
+// wrappers that keep state, such as chunk.Wrap, and may even be the same kind of remote.
+//
+// Optional interfaces of the inner remotes are not passed through, except that the config
+// settings of both are listed.
+type TieredRemote struct {
+	TieredConfig
+
+	hot, cold RemoteV1
+	tmpDir    string
+	indexDir  string
+}
+
+// tierInfo is the state recorded for each key.
+type tierInfo struct {
+	Hot   bool  `json:"h,omitempty"`
+	Cold  bool  `json:"c,omitempty"`
+	Since int64 `json:"t,omitempty"`
+}
+
+var tierState = &State{Name: "tier", Version: 1}
+
+// Tiered returns a remote that keeps content in the hot remote and migrates it to the cold remote.
+func Tiered(hot, cold RemoteV1) *TieredRemote {
+	return &TieredRemote{hot: hot, cold: cold}
+}
+
+// ListConfigs lists the tiering settings followed by those of the inner remotes, omitting
+// duplicates.
+func (t *TieredRemote) ListConfigs(a Annex) []ConfigSetting {
+	configs := NewConfig(&TieredConfig{}).ListConfigs()
+	seen := make(map[string]bool)
+	for _, c := range configs {
+		seen[c.Name] = true
+	}
+	for _, r := range []RemoteV1{t.hot, t.cold} {
+		var h HasListConfigs
+		if !As(r, &h) {
+			continue
+		}
+		for _, c := range h.ListConfigs(a) {
+			if !seen[c.Name] {
+				seen[c.Name] = true
+				configs = append(configs, c)
+			}
+		}
+	}
+	return configs
+}
+
+// Init validates the settings and initializes both tiers.
+func (t *TieredRemote) Init(a Annex) error {
+	if err := NewConfig(&t.TieredConfig).Load(a); err != nil {
+		return err
+	}
+	if err := t.hot.Init(t.hotAnnex(a)); err != nil {
+		return fmt.Errorf("hot tier: %w", err)
+	}
+	if err := t.cold.Init(t.coldAnnex(a)); err != nil {
+		return fmt.Errorf("cold tier: %w", err)
+	}
+	return nil
+}
+
+// Prepare loads the settings and prepares both tiers.
+func (t *TieredRemote) Prepare(a Annex) error {
+	if err := NewConfig(&t.TieredConfig).Load(a); err != nil {
+		return err
+	}
+	t.tmpDir = filepath.Join(a.GetGitDir(), "annex", "tmp")
+	t.indexDir = filepath.Join(a.GetGitDir(), "annex", "tiered", a.GetUUID())
+	if err := t.hot.Prepare(t.hotAnnex(a)); err != nil {
+		return fmt.Errorf("hot tier: %w", err)
+	}
+	if err := t.cold.Prepare(t.coldAnnex(a)); err != nil {
+		return fmt.Errorf("cold tier: %w", err)
+	}
+	if t.MaxAge > 0 {
+		t.sweep(a)
+	}
+	return nil
+}
+
+func (t *TieredRemote) hotAnnex(a Annex) Annex {
+	return stateNamespaceAnnex{a, "hot"}
+}
+
+func (t *TieredRemote) coldAnnex(a Annex) Annex {
+	return stateNamespaceAnnex{a, "cold"}
+}
+
+func (t *TieredRemote) info(a Annex, key string) (tierInfo, bool) {
+	var i tierInfo
+	ok, err := tierState.Get(a, key, &i)
+	if err != nil {
+		a.Debugf("reading tier state for %s: %v", key, err)
+	}
+	return i, ok && err == nil && (i.Hot || i.Cold)
+}
+
+func (t *TieredRemote) setInfo(a Annex, key string, i tierInfo) error {
+	if !i.Hot && !i.Cold {
+		tierState.Clear(a, key)
+		return nil
+	}
+	return tierState.Set(a, key, i)
+}
+
+// Store stores the key in the hot tier, or in the cold tier if it is too large for the hot tier.
+func (t *TieredRemote) Store(a Annex, key, file string) error {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if t.MaxSize > 0 && stat.Size() > int64(t.MaxSize) {
+		a.Debugf("storing %s (%d bytes) directly in the cold tier", key, stat.Size())
+		if err := t.cold.Store(t.coldAnnex(a), key, file); err != nil {
+			return err
+		}
+		// Any copy already in the hot tier stays there, to be migrated or removed as usual.
+		i, _ := t.info(a, key)
+		i.Cold = true
+		return t.setInfo(a, key, i)
+	}
+	if err := t.hot.Store(t.hotAnnex(a), key, file); err != nil {
+		return err
+	}
+	i, _ := t.info(a, key)
+	i.Hot, i.Since = true, time.Now().Unix()
+	if err := t.setInfo(a, key, i); err != nil {
+		return err
+	}
+	t.index(a, key)
+	return nil
+}
+
+func (t *TieredRemote) tempFile() (string, error) {
+	if err := os.MkdirAll(t.tmpDir, 0o700); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(t.tmpDir, "tiered-")
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// Retrieve retrieves the key from the hot tier if it is there and from the cold tier otherwise.
+func (t *TieredRemote) Retrieve(a Annex, key, file string) error {
+	i, known := t.info(a, key)
+	if !known || i.Hot {
+		err := t.hot.Retrieve(t.hotAnnex(a), key, file)
+		if err == nil {
+			return nil
+		}
+		if known && !i.Cold {
+			return err
+		}
+		a.Debugf("retrieving %s from the hot tier: %v", key, err)
+	}
+	if err := t.cold.Retrieve(t.coldAnnex(a), key, file); err != nil {
+		return err
+	}
+	if t.Promote {
+		if err := t.hot.Store(t.hotAnnex(a), key, file); err != nil {
+			a.Debugf("promoting %s to the hot tier: %v", key, err)
+			return nil
+		}
+		if err := t.setInfo(a, key, tierInfo{Hot: true, Cold: true, Since: time.Now().Unix()}); err != nil {
+			a.Debugf("recording promotion of %s: %v", key, err)
+			return nil
+		}
+		t.index(a, key)
+	}
+	return nil
+}
+
+// Present checks whether either tier holds the key.
+func (t *TieredRemote) Present(a Annex, key string) (bool, error) {
+	i, known := t.info(a, key)
+	if !known {
+		if present, err := t.hot.Present(t.hotAnnex(a), key); err != nil || present {
+			return present, err
+		}
+		return t.cold.Present(t.coldAnnex(a), key)
+	}
+	if i.Hot {
+		present, err := t.hot.Present(t.hotAnnex(a), key)
+		if err == nil && present {
+			return true, nil
+		}
+		if !i.Cold {
+			return present, err
+		}
+	}
+	return t.cold.Present(t.coldAnnex(a), key)
+}
+
+// Remove removes the key from both tiers.
+func (t *TieredRemote) Remove(a Annex, key string) error {
+	i, known := t.info(a, key)
+	if !known {
+		i = tierInfo{Hot: true, Cold: true}
+	}
+	if i.Hot {
+		if err := t.hot.Remove(t.hotAnnex(a), key); err != nil {
+			return fmt.Errorf("hot tier: %w", err)
+		}
+		i.Hot = false
+		t.unindex(a, key)
+	}
+	if i.Cold {
+		if err := t.cold.Remove(t.coldAnnex(a), key); err != nil {
+			// Record that the hot copy is gone before failing.
+			_ = t.setInfo(a, key, i)
+			return fmt.Errorf("cold tier: %w", err)
+		}
+		i.Cold = false
+	}
+	return t.setInfo(a, key, i)
+}
+
+// WhereIs reports which tiers hold the key.
+func (t *TieredRemote) WhereIs(a Annex, key string) string {
+	i, known := t.info(a, key)
+	switch {
+	case !known:
+		return ""
+	case i.Hot && i.Cold:
+		return "hot and cold tiers"
+	case i.Hot:
+		return "hot tier"
+	default:
+		return "cold tier"
+	}
+}
+
+func (t *TieredRemote) due(i tierInfo) bool {
+	return i.Hot && t.MaxAge > 0 && i.Since > 0 && time.Since(time.Unix(i.Since, 0)) > t.MaxAge
+}
+
+// indexFile returns the file listing the key in the index of keys put in the hot tier.
+func (t *TieredRemote) indexFile(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(t.indexDir, hex.EncodeToString(sum[:]))
+}
+
+// index adds the key to the index of keys put in the hot tier, so that Prepare will migrate it when
+// it is due. Failure only means that the key is not swept, so it is not an error.
+func (t *TieredRemote) index(a Annex, key string) {
+	if t.MaxAge <= 0 {
+		return
+	}
+	err := os.MkdirAll(t.indexDir, 0o700)
+	if err == nil {
+		err = ioutil.WriteFile(t.indexFile(key), []byte(key), 0o600)
+	}
+	if err != nil {
+		a.Debugf("indexing %s: %v", key, err)
+	}
+}
+
+func (t *TieredRemote) unindex(a Annex, key string) {
+	if err := os.Remove(t.indexFile(key)); err != nil && !os.IsNotExist(err) {
+		a.Debugf("unindexing %s: %v", key, err)
+	}
+}
+
+// sweep migrates the indexed keys that are due and drops the keys that are no longer in the hot
+// tier from the index.
+func (t *TieredRemote) sweep(a Annex) {
+	entries, err := ioutil.ReadDir(t.indexDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			a.Debugf("reading the tier index: %v", err)
+		}
+		return
+	}
+	for _, e := range entries {
+		data, err := ioutil.ReadFile(filepath.Join(t.indexDir, e.Name()))
+		if err != nil {
+			a.Debugf("reading the tier index: %v", err)
+			continue
+		}
+		key := string(data)
+		if i, known := t.info(a, key); !known || !i.Hot {
+			t.unindex(a, key)
+			continue
+		}
+		if _, err := t.Migrate(a, key); err != nil {
+			a.Debugf("migrating %s to the cold tier: %v", key, err)
+		}
+	}
+}
+
+// Migrate moves the key from the hot tier to the cold tier if it has been in the hot tier for
+// longer than the hotmaxage setting. It reports whether the key was moved.
+func (t *TieredRemote) Migrate(a Annex, key string) (bool, error) {
+	i, known := t.info(a, key)
+	if !known || !t.due(i) {
+		return false, nil
+	}
+	// Migration happens outside of any transfer, so its transfers must not report progress.
+	a = quietAnnex{a}
+	if !i.Cold {
+		tmp, err := t.tempFile()
+		if err != nil {
+			return false, err
+		}
+		defer os.Remove(tmp)
+		if err := t.hot.Retrieve(t.hotAnnex(a), key, tmp); err != nil {
+			return false, err
+		}
+		if err := t.cold.Store(t.coldAnnex(a), key, tmp); err != nil {
+			return false, err
+		}
+		i.Cold = true
+		if err := t.setInfo(a, key, i); err != nil {
+			return false, err
+		}
+	}
+	if err := t.hot.Remove(t.hotAnnex(a), key); err != nil {
+		return false, err
+	}
+	i.Hot, i.Since = false, 0
+	t.unindex(a, key)
+	a.Debugf("migrated %s to the cold tier", key)
+	return true, t.setInfo(a, key, i)
+}
+
+// quietAnnex discards progress reports.
+type quietAnnex struct {
+	Annex
+}
+
+func (quietAnnex) Progress(bytes int) {}
+
+// Statically ensure that the combinator satisfies the interfaces used by the library.
+var (
+	_ RemoteV1       = (*TieredRemote)(nil)
+	_ HasListConfigs = (*TieredRemote)(nil)
+	_ HasWhereIs     = (*TieredRemote)(nil)
+)
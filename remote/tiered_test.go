@@ -0,0 +1,104 @@
+package remote
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tieredTestAnnex adds a configuration and a git directory to progressTestAnnex.
+type tieredTestAnnex struct {
+	progressTestAnnex
+	config map[string]string
+	gitDir string
+}
+
+func newTieredTestAnnex(t *testing.T, config map[string]string) *tieredTestAnnex {
+	return &tieredTestAnnex{progressTestAnnex{newTestAnnex()}, config, t.TempDir()}
+}
+
+func (a *tieredTestAnnex) GetConfig(setting string) string { return a.config[setting] }
+func (a *tieredTestAnnex) GetGitDir() string               { return a.gitDir }
+func (a *tieredTestAnnex) GetUUID() string                 { return "uuid" }
+
+func writeTestFile(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestTieredLargeStoreKeepsHotCopy(t *testing.T) {
+	a := newTieredTestAnnex(t, map[string]string{"hotmaxsize": "4"})
+	hot, cold := newStateRemote(), newStateRemote()
+	tr := Tiered(hot, cold)
+	if err := tr.Prepare(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Store(a, "K", writeTestFile(t, "ab")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Store(a, "K", writeTestFile(t, "abcdefgh")); err != nil {
+		t.Fatal(err)
+	}
+	if i, _ := tr.info(a, "K"); !i.Hot || !i.Cold {
+		t.Errorf("tier state = %+v, want both tiers", i)
+	}
+	if err := tr.Remove(a, "K"); err != nil {
+		t.Fatal(err)
+	}
+	if len(hot.objects) != 0 || len(cold.objects) != 0 {
+		t.Errorf("Remove left objects %v and %v", hot.objects, cold.objects)
+	}
+}
+
+func TestTieredSweep(t *testing.T) {
+	a := newTieredTestAnnex(t, map[string]string{"hotmaxage": "1h"})
+	hot, cold := newStateRemote(), newStateRemote()
+	tr := Tiered(hot, cold)
+	if err := tr.Prepare(a); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"old", "new"} {
+		if err := tr.Store(a, key, writeTestFile(t, key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	i, _ := tr.info(a, "old")
+	i.Since = time.Now().Add(-2 * time.Hour).Unix()
+	if err := tr.setInfo(a, "old", i); err != nil {
+		t.Fatal(err)
+	}
+
+	// Retrieving a key that is due does not move it.
+	if err := tr.Retrieve(a, "old", filepath.Join(t.TempDir(), "out")); err != nil {
+		t.Fatal(err)
+	}
+	if i, _ := tr.info(a, "old"); !i.Hot || i.Cold {
+		t.Errorf("tier state after Retrieve = %+v, want the hot tier only", i)
+	}
+
+	// The next Prepare does.
+	if err := Tiered(hot, cold).Prepare(a); err != nil {
+		t.Fatal(err)
+	}
+	if i, _ := tr.info(a, "old"); i.Hot || !i.Cold {
+		t.Errorf("tier state of due key after Prepare = %+v, want the cold tier only", i)
+	}
+	if i, _ := tr.info(a, "new"); !i.Hot || i.Cold {
+		t.Errorf("tier state of new key after Prepare = %+v, want the hot tier only", i)
+	}
+	if len(hot.objects) != 1 || len(cold.objects) != 1 {
+		t.Errorf("tiers hold %d and %d objects, want 1 and 1", len(hot.objects), len(cold.objects))
+	}
+	entries, err := ioutil.ReadDir(tr.indexDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("index lists %d keys, want 1", len(entries))
+	}
+}
@@ -0,0 +1,317 @@
+// Package verify provides a wrapper for external special remotes that checks the content of each
+// key after storing it, so that an object truncated or corrupted by the remote is reported to
+// git-annex as a failed transfer instead of being recorded as present. An object that fails the
+// checks is removed from the remote.
+//
+// After the wrapped remote stores a key, the wrapper checks the stored object's size against the
+// key's size field (or the size of the file that was stored, if the key has none) and, for keys of
+// hash backends such as SHA256E, the object's checksum against the hash in the key. Keys of other
+// backends, such as WORM, are checked against a checksum of the file that was stored instead.
+//
+// If the wrapped remote itself implements HasVerifyStored, the wrapper uses the size and checksum it
+// reports; otherwise, it retrieves the object again with Retrieve. Remotes further down are not
+// asked, since a wrapper in between, such as one that compresses or chunks content, may store
+// something other than the key's content. The checks are controlled by the "verify" config
+// setting: "full" (the default) checks sizes and checksums, "size" checks only sizes, and "no"
+// disables verification.
+//
+// Only Store is verified; exports through the wrapper are not.
+package verify
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dzhu/go-git-annex-external/key"
+	"github.com/dzhu/go-git-annex-external/remote"
+)
+
+// Verification levels accepted by the "verify" config setting.
+const (
+	LevelFull = "full"
+	LevelSize = "size"
+	LevelNone = "no"
+)
+
+// Config is the configuration read by the wrapper.
+type Config struct {
+	Level string `config:"verify" default:"full" enum:"full,size,no" desc:"how to check content after storing it"`
+}
+
+// StoredObject describes an object held by a remote.
+type StoredObject struct {
+	// Size is the size of the object in bytes, or -1 if it is not known.
+	Size int64
+	// Hash names the algorithm of Sum, using the names of git-annex's hash backends, such as
+	// "SHA256" or "MD5". It is empty if no checksum is known.
+	Hash string
+	// Sum is the checksum of the object's content.
+	Sum []byte
+}
+
+// HasVerifyStored may be implemented by a remote to report what it holds for a key more cheaply
+// than by retrieving it, typically from metadata returned by the remote's storage service.
+type HasVerifyStored interface {
+	VerifyStored(a remote.Annex, key string) (StoredObject, error)
+}
+
+// MismatchError is returned by Store when the stored object does not match the content that was
+// stored.
+type MismatchError struct {
+	Key          string
+	What         string
+	Want, Stored string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("verifying %s: stored %s %s does not match expected %s", e.Key, e.What, e.Stored, e.Want)
+}
+
+// Remote wraps a remote to verify the content it stores.
+type Remote struct {
+	remote.RemoteV1
+	Config
+
+	tmpDir string
+}
+
+// Wrap returns a remote that verifies the content stored by r.
+func Wrap(r remote.RemoteV1) *Remote {
+	return &Remote{RemoteV1: r, Config: Config{Level: LevelFull}}
+}
+
+// Unwrap returns the wrapped remote.
+func (r *Remote) Unwrap() remote.RemoteV1 {
+	return r.RemoteV1
+}
+
+// ListConfigs returns the settings of the wrapper followed by those of the wrapped remote.
+func (r *Remote) ListConfigs(a remote.Annex) []remote.ConfigSetting {
+	configs := remote.NewConfig(&Config{}).ListConfigs()
+	var h remote.HasListConfigs
+	if remote.As(r.RemoteV1, &h) {
+		configs = append(configs, h.ListConfigs(a)...)
+	}
+	return configs
+}
+
+// Init validates the settings and initializes the wrapped remote.
+func (r *Remote) Init(a remote.Annex) error {
+	var c Config
+	if err := remote.NewConfig(&c).Load(a); err != nil {
+		return err
+	}
+	return r.RemoteV1.Init(a)
+}
+
+// Prepare loads the settings and prepares the wrapped remote.
+func (r *Remote) Prepare(a remote.Annex) error {
+	if err := remote.NewConfig(&r.Config).Load(a); err != nil {
+		return err
+	}
+	r.tmpDir = filepath.Join(a.GetGitDir(), "annex", "tmp")
+	return r.RemoteV1.Prepare(a)
+}
+
+// Store stores the key with the wrapped remote and then verifies the stored object. An object that
+// does not match is removed again, so that it is not mistaken for the key's content later.
+func (r *Remote) Store(a remote.Annex, key, file string) error {
+	if err := r.RemoteV1.Store(a, key, file); err != nil {
+		return err
+	}
+	if r.Level == LevelNone {
+		return nil
+	}
+	err := r.verify(a, key, file)
+	var mismatch *MismatchError
+	if errors.As(err, &mismatch) {
+		if rerr := r.RemoteV1.Remove(a, key); rerr != nil {
+			return fmt.Errorf("%w (removing the stored object failed: %v)", err, rerr)
+		}
+	}
+	return err
+}
+
+// expectation is what a stored object must match.
+type expectation struct {
+	key  string
+	file string
+	size int64
+	// hash and sum are the algorithm and checksum given by the key, if it belongs to a hash backend.
+	hash string
+	sum  []byte
+}
+
+func (r *Remote) expect(k, file string) (*expectation, error) {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	e := &expectation{key: k, file: file, size: stat.Size()}
+	parsed, err := key.Parse(k)
+	// The size and hash in a chunk key describe the whole content, not the chunk.
+	if err != nil || parsed.IsChunk() {
+		return e, nil
+	}
+	if parsed.HasSize {
+		e.size = parsed.Size
+	}
+	if name := strings.TrimSuffix(parsed.Backend, "E"); newHash(name) != nil {
+		if sum, err := hex.DecodeString(parsed.Name); err == nil {
+			e.hash, e.sum = name, sum
+		}
+	}
+	return e, nil
+}
+
+// sumFor returns the expected checksum of the content using the named hash algorithm, from the key
+// if possible and by hashing the stored file otherwise. It returns nil if the algorithm is not
+// supported.
+func (e *expectation) sumFor(name string) ([]byte, error) {
+	if name == e.hash {
+		return e.sum, nil
+	}
+	h := newHash(name)
+	if h == nil {
+		return nil, nil
+	}
+	f, err := os.Open(e.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func (e *expectation) checkSize(size int64) error {
+	if size >= 0 && size != e.size {
+		return &MismatchError{Key: e.key, What: "size", Want: strconv.FormatInt(e.size, 10), Stored: strconv.FormatInt(size, 10)}
+	}
+	return nil
+}
+
+func (e *expectation) checkSum(name string, sum []byte) error {
+	want, err := e.sumFor(name)
+	if err != nil || want == nil {
+		return err
+	}
+	if !bytes.Equal(want, sum) {
+		return &MismatchError{Key: e.key, What: name + " checksum", Want: hex.EncodeToString(want), Stored: hex.EncodeToString(sum)}
+	}
+	return nil
+}
+
+func (r *Remote) verify(a remote.Annex, key, file string) error {
+	e, err := r.expect(key, file)
+	if err != nil {
+		return err
+	}
+	if h, ok := r.RemoteV1.(HasVerifyStored); ok {
+		obj, err := h.VerifyStored(a, key)
+		if err != nil {
+			return fmt.Errorf("verifying %s: %w", key, err)
+		}
+		if err := e.checkSize(obj.Size); err != nil {
+			return err
+		}
+		if r.Level == LevelFull && obj.Hash != "" {
+			if newHash(obj.Hash) == nil {
+				a.Debugf("not verifying %s: unsupported checksum %s", key, obj.Hash)
+				return nil
+			}
+			return e.checkSum(obj.Hash, obj.Sum)
+		}
+		return nil
+	}
+	return r.verifyByRetrieving(a, e)
+}
+
+func (r *Remote) verifyByRetrieving(a remote.Annex, e *expectation) error {
+	if err := os.MkdirAll(r.tmpDir, 0o700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(r.tmpDir, "verify-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	f.Close()
+	defer os.Remove(tmp)
+
+	// The store has already reported its progress, so the retrieval must not report any of its own.
+	if err := r.RemoteV1.Retrieve(quietAnnex{a}, e.key, tmp); err != nil {
+		return fmt.Errorf("verifying %s: %w", e.key, err)
+	}
+	stat, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	if err := e.checkSize(stat.Size()); err != nil {
+		return err
+	}
+	if r.Level != LevelFull {
+		return nil
+	}
+	name := e.hash
+	if name == "" {
+		name = "SHA256"
+	}
+	h := newHash(name)
+	if f, err = os.Open(tmp); err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	return e.checkSum(name, h.Sum(nil))
+}
+
+// newHash returns a new hash for the named git-annex hash backend, or nil if it is not supported.
+func newHash(name string) hash.Hash {
+	switch name {
+	case "MD5":
+		return md5.New()
+	case "SHA1":
+		return sha1.New()
+	case "SHA224":
+		return sha256.New224()
+	case "SHA256":
+		return sha256.New()
+	case "SHA384":
+		return sha512.New384()
+	case "SHA512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// quietAnnex discards progress reports.
+type quietAnnex struct {
+	remote.Annex
+}
+
+func (quietAnnex) Progress(bytes int) {}
+
+// Statically ensure that the wrapper satisfies the interfaces used by the library.
+var (
+	_ remote.RemoteV1       = (*Remote)(nil)
+	_ remote.Unwrapper      = (*Remote)(nil)
+	_ remote.HasListConfigs = (*Remote)(nil)
+)
@@ -0,0 +1,36 @@
+package remote
+
+import "reflect"
+
+// Unwrapper is implemented by remotes that wrap another remote to add behavior to it, such as
+// caching or chunking. When git-annex sends a message handled by one of the optional "Has*"
+// interfaces, the first remote in the chain formed by successive calls to Unwrap that implements
+// the interface handles it, so a wrapper only needs to implement the optional interfaces whose
+// behavior it changes.
+type Unwrapper interface {
+	Unwrap() RemoteV1
+}
+
+// As finds the first remote in the chain starting at r that implements the interface pointed to by
+// target and, if there is one, sets target to that remote and returns true. The chain consists of
+// r followed by the remotes obtained by repeatedly calling Unwrap. It panics if target is not a
+// non-nil pointer to an interface type.
+func As(r RemoteV1, target interface{}) bool {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Interface {
+		panic("remote.As: target must be a non-nil pointer to an interface type")
+	}
+	t := v.Elem().Type()
+	for r != nil {
+		if reflect.TypeOf(r).Implements(t) {
+			v.Elem().Set(reflect.ValueOf(r))
+			return true
+		}
+		u, ok := r.(Unwrapper)
+		if !ok {
+			break
+		}
+		r = u.Unwrap()
+	}
+	return false
+}